@@ -0,0 +1,194 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrTampered = errors.New("audit log has been tampered with")
+
+// Record type describes a single mutating request made to vile
+type Record struct {
+	Index     uint64    `json:"index"`               // Position of the record in the audit log
+	Time      time.Time `json:"time"`                // Time the request was handled
+	Identity  string    `json:"identity"`            // Who made the request
+	SourceIP  string    `json:"source_ip"`           // Address the request was sent from
+	RequestID string    `json:"request_id"`          // ID of the request
+	Operation string    `json:"operation"`           // HTTP method and route template of the request
+	Namespace string    `json:"namespace,omitempty"` // Namespace the request was made to
+	Key       string    `json:"key,omitempty"`       // Key modified by the request
+	Field     string    `json:"field,omitempty"`     // Hash field modified by the request
+	Status    int       `json:"status"`              // HTTP status code returned
+	Sequence  uint64    `json:"sequence,omitempty"`  // Sequence of the resulting transaction log event
+	PrevHash  string    `json:"prev_hash"`           // Hash of the previous record
+	Hash      string    `json:"hash"`                // Hash of this record, chained to the previous record
+}
+
+// Filter type selects the records returned by a query, zero
+// valued fields match every record
+type Filter struct {
+	Identity  string    // Only records made by this identity
+	Operation string    // Only records of this operation
+	Namespace string    // Only records made to this namespace
+	Key       string    // Only records modifying this key
+	Field     string    // Only records modifying this hash field
+	Since     time.Time // Only records made at or after this time
+	Until     time.Time // Only records made before this time
+	Limit     int       // Maximum number of records, keeping the most recent
+}
+
+// Log type is an append-only audit trail stored as a file of JSON records, each of
+// which contains the hash of the previous record so that any modification,
+// removal or reordering of records breaks the chain and can be detected
+type Log struct {
+	mu       sync.Mutex
+	file     *os.File // The location of the audit log
+	index    uint64   // Index of the last record
+	lastHash string   // Hash of the last record
+}
+
+// Open opens the audit log at path, creating it if necessary, and
+// verifies its hash chain before allowing records to be appended
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log file: %w", err)
+	}
+	l := &Log{file: file}
+	err = l.scan(func(r Record) {
+		l.index, l.lastHash = r.Index, r.Hash
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Append adds the record to the end of the audit log, assigning its index and
+// chaining its hash to the previous record, and returns the stored record
+func (l *Log) Append(r Record) (Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	r.Time = r.Time.UTC()
+	r.Index = l.index + 1
+	r.PrevHash = l.lastHash
+	r.Hash = hashRecord(r)
+	line, err := json.Marshal(r)
+	if err != nil {
+		return r, fmt.Errorf("cannot encode audit record: %w", err)
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		return r, fmt.Errorf("cannot write to audit log file: %w", err)
+	}
+	// Records must survive a crash to be useful as evidence
+	if err = l.file.Sync(); err != nil {
+		return r, fmt.Errorf("cannot sync audit log file: %w", err)
+	}
+	l.index, l.lastHash = r.Index, r.Hash
+	return r, nil
+}
+
+// Query returns the records matching the filter in the order they were made,
+// or ErrTampered if the hash chain of the audit log is broken
+func (l *Log) Query(f Filter) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := []Record{}
+	err := l.scan(func(r Record) {
+		if f.matches(r) {
+			records = append(records, r)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if f.Limit > 0 && len(records) > f.Limit {
+		records = records[len(records)-f.Limit:]
+	}
+	return records, nil
+}
+
+// Verify checks the hash chain of the whole audit log,
+// returning ErrTampered if it has been modified
+func (l *Log) Verify() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.scan(func(Record) {})
+}
+
+// Close closes the audit log file
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// scan reads every record from the start of the file, verifying the
+// hash chain, and calls fn for each record. The caller must hold the lock
+// unless the log has not been shared yet
+func (l *Log) scan(fn func(Record)) error {
+	f, err := os.Open(l.file.Name())
+	if err != nil {
+		return fmt.Errorf("cannot open audit log file: %w", err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	prev := Record{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("audit log read failure: %w", err)
+		}
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("%w: record %d cannot be decoded", ErrTampered, prev.Index+1)
+		}
+		if r.Index != prev.Index+1 || r.PrevHash != prev.Hash || r.Hash != hashRecord(r) {
+			return fmt.Errorf("%w: record %d does not match the hash chain", ErrTampered, prev.Index+1)
+		}
+		fn(r)
+		prev = r
+	}
+}
+
+// hashRecord returns the hash of every field of the record except its own hash
+func hashRecord(r Record) string {
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// matches reports whether the record is selected by the filter
+func (f Filter) matches(r Record) bool {
+	switch {
+	case f.Identity != "" && r.Identity != f.Identity:
+		return false
+	case f.Operation != "" && r.Operation != f.Operation:
+		return false
+	case f.Namespace != "" && r.Namespace != f.Namespace:
+		return false
+	case f.Key != "" && r.Key != f.Key:
+		return false
+	case f.Field != "" && r.Field != f.Field:
+		return false
+	case !f.Since.IsZero() && r.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !r.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
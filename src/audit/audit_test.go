@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openHelper opens an audit log in a temporary directory
+func openHelper(t *testing.T) (*Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error while opening audit log: %q", err)
+	}
+	return l, path
+}
+
+func TestAppendAndQuery(t *testing.T) {
+	l, path := openHelper(t)
+	start := time.Now()
+	records := []Record{
+		{Identity: "token:a", Operation: "PUT", Namespace: "a", Key: "key1", Sequence: 1},
+		{Identity: "anonymous", Operation: "PUT", Namespace: "default", Key: "key1", Sequence: 2},
+		{Identity: "token:a", Operation: "DELETE", Namespace: "a", Key: "key1", Sequence: 3},
+	}
+	for _, r := range records {
+		if _, err := l.Append(r); err != nil {
+			t.Fatalf("unexpected error while appending record: %q", err)
+		}
+	}
+	l.Close()
+	// Reopening the log should continue the existing chain
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error while reopening audit log: %q", err)
+	}
+	defer l.Close()
+	last, err := l.Append(Record{Identity: "anonymous", Operation: "PUT", Key: "key2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Index != 4 {
+		t.Fatalf("expected index 4, instead got %d", last.Index)
+	}
+	testCases := []struct {
+		name     string // Name of test
+		filter   Filter // Filter to query with
+		expected int    // Expected number of records
+	}{
+		{"All", Filter{}, 4},
+		{"Identity", Filter{Identity: "token:a"}, 2},
+		{"Operation", Filter{Operation: "DELETE"}, 1},
+		{"NamespaceAndKey", Filter{Namespace: "a", Key: "key1"}, 2},
+		{"Since", Filter{Since: start}, 4},
+		{"Until", Filter{Until: start}, 0},
+		{"Limit", Filter{Limit: 3}, 3},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			found, err := l.Query(tc.filter)
+			if err != nil {
+				t.Fatalf("unexpected error while querying: %q", err)
+			}
+			if len(found) != tc.expected {
+				t.Fatalf("expected %d records, instead got %d", tc.expected, len(found))
+			}
+		})
+	}
+}
+
+func TestTamperEvidence(t *testing.T) {
+	l, path := openHelper(t)
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if _, err := l.Append(Record{Operation: "PUT", Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Verify(); err != nil {
+		t.Fatalf("unexpected error while verifying untouched log: %q", err)
+	}
+	l.Close()
+	// Rewriting a record should break the hash chain
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(contents), `"key":"key2"`, `"key":"other"`, 1)
+	if err := os.WriteFile(path, []byte(tampered), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected %q, instead got %q", ErrTampered, err)
+	}
+	// Removing a record should also break the chain
+	lines := strings.SplitAfter(string(contents), "\n")
+	if err := os.WriteFile(path, []byte(lines[0]+lines[2]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); !errors.Is(err, ErrTampered) {
+		t.Fatalf("expected %q, instead got %q", ErrTampered, err)
+	}
+}
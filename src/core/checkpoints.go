@@ -0,0 +1,81 @@
+package core
+
+import "sync"
+
+// checkpoints tracks the transaction log sequences assigned to writes until
+// they are persisted by the engines of every namespace
+var checkpoints = newCheckpointTracker()
+
+// checkpointTracker type works out the checkpoint recorded by engines, which
+// must not get ahead of a sequence that hasn't been persisted. Sequences are
+// assigned before writes take the engines' locks, so writes can be persisted
+// out of order and the highest persisted sequence isn't always safe to record
+type checkpointTracker struct {
+	mu        sync.Mutex
+	pending   map[uint64]struct{} // Sequences assigned to writes that are yet to be persisted
+	assigning map[uint64]int      // Number of writes being assigned a sequence, by the highest sequence known when they started
+	highest   uint64              // Highest sequence assigned
+	applied   uint64              // Highest sequence persisted
+}
+
+// newCheckpointTracker creates a tracker with no pending sequences
+func newCheckpointTracker() *checkpointTracker {
+	return &checkpointTracker{pending: make(map[uint64]struct{}), assigning: make(map[uint64]int)}
+}
+
+// assign calls commit and records the sequence it returns as pending. The lock
+// isn't held while commit runs, instead the write is recorded as being assigned
+// a sequence, which will be later than every sequence known when it started, so
+// that checkpoints don't get ahead of it before its sequence is known
+func (c *checkpointTracker) assign(commit Commit) uint64 {
+	c.mu.Lock()
+	known := c.highest
+	c.assigning[known]++
+	c.mu.Unlock()
+	sequence := commit()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.assigning[known]--; c.assigning[known] == 0 {
+		delete(c.assigning, known)
+	}
+	if sequence != 0 {
+		c.pending[sequence] = struct{}{}
+		c.highest = max(c.highest, sequence)
+	}
+	return sequence
+}
+
+// checkpoint returns the checkpoint that may be recorded along with the write of
+// the sequence, which is the highest sequence persisted, including this one,
+// that is lower than every other pending sequence and every sequence still being
+// assigned. Writes without a sequence get 0, which leaves the checkpoint as it is
+func (c *checkpointTracker) checkpoint(sequence uint64) uint64 {
+	if sequence == 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	checkpoint := max(c.applied, sequence)
+	for pending := range c.pending {
+		if pending != sequence && pending <= checkpoint {
+			checkpoint = pending - 1
+		}
+	}
+	for known := range c.assigning {
+		checkpoint = min(checkpoint, known)
+	}
+	return checkpoint
+}
+
+// persisted records that the write of the sequence has been persisted. Writes
+// that fail leave their sequence pending, so checkpoints stay below it and
+// the write is replayed from the transaction log after a restart
+func (c *checkpointTracker) persisted(sequence uint64) {
+	if sequence == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, sequence)
+	c.applied = max(c.applied, sequence)
+}
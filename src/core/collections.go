@@ -0,0 +1,148 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ValueType type identifies how the value of an entry is structured, values
+// other than strings are encoded as JSON so that engines can store them as is
+type ValueType string
+
+const (
+	TypeString ValueType = ""     // Value is an opaque string
+	TypeList   ValueType = "list" // Value is a JSON array of strings, in list order
+	TypeSet    ValueType = "set"  // Value is a JSON array of distinct strings, sorted
+	TypeHash   ValueType = "hash" // Value is a JSON object of string fields, sorted by field
+)
+
+// ParseValueType returns the value type with the provided name
+func ParseValueType(name string) (ValueType, error) {
+	switch t := ValueType(name); t {
+	case TypeString, TypeList, TypeSet, TypeHash:
+		return t, nil
+	}
+	return TypeString, fmt.Errorf("unknown value type %q", name)
+}
+
+var ErrWrongType = errors.New("value is of the wrong type")
+var ErrEmptyList = errors.New("list is empty")
+
+// Members returns the elements of a list or set entry, in order
+func (e Entry) Members() ([]string, error) {
+	if e.Type != TypeList && e.Type != TypeSet {
+		return nil, ErrWrongType
+	}
+	var members []string
+	if err := json.Unmarshal([]byte(e.Value), &members); err != nil {
+		return nil, fmt.Errorf("cannot decode %s value: %w", e.Type, err)
+	}
+	return members, nil
+}
+
+// members returns the elements of the entry if it exists and is of the
+// provided type, or no elements if it doesn't exist
+func members(old Entry, exists bool, t ValueType) ([]string, error) {
+	if !exists {
+		return []string{}, nil
+	}
+	if old.Type != t {
+		return nil, ErrWrongType
+	}
+	return old.Members()
+}
+
+// collection returns the entry holding the elements as a value of the type
+func collection(t ValueType, elements []string) (Entry, error) {
+	value, err := json.Marshal(elements)
+	if err != nil {
+		return Entry{}, fmt.Errorf("cannot encode %s value: %w", t, err)
+	}
+	return Entry{Value: string(value), Type: t}, nil
+}
+
+// Append returns an Update adding the suffix to the end of a string value,
+// keys that don't exist are treated as empty strings
+func Append(suffix string) Update {
+	return func(old Entry, exists bool) (Entry, error) {
+		if exists && old.Type != TypeString {
+			return Entry{}, ErrWrongType
+		}
+		return Entry{Value: old.Value + suffix}, nil
+	}
+}
+
+// Push returns an Update adding the element to the front of a list value, or
+// to its back unless front is set. Keys that don't exist are treated as empty lists
+func Push(element string, front bool) Update {
+	return func(old Entry, exists bool) (Entry, error) {
+		list, err := members(old, exists, TypeList)
+		if err != nil {
+			return Entry{}, err
+		}
+		if front {
+			list = append([]string{element}, list...)
+		} else {
+			list = append(list, element)
+		}
+		return collection(TypeList, list)
+	}
+}
+
+// Pop returns an Update removing the element at the front of a list value, or
+// at its back unless front is set, and storing it in popped. It returns
+// ErrNoSuchKey if the key doesn't exist, or ErrEmptyList if the list is empty
+func Pop(front bool, popped *string) Update {
+	return func(old Entry, exists bool) (Entry, error) {
+		if !exists {
+			return Entry{}, ErrNoSuchKey
+		}
+		list, err := members(old, exists, TypeList)
+		if err != nil {
+			return Entry{}, err
+		}
+		if len(list) == 0 {
+			return Entry{}, ErrEmptyList
+		}
+		if front {
+			*popped, list = list[0], list[1:]
+		} else {
+			*popped, list = list[len(list)-1], list[:len(list)-1]
+		}
+		return collection(TypeList, list)
+	}
+}
+
+// SetAdd returns an Update adding the member to a set value if it isn't
+// already a member, keys that don't exist are treated as empty sets
+func SetAdd(member string) Update {
+	return func(old Entry, exists bool) (Entry, error) {
+		set, err := members(old, exists, TypeSet)
+		if err != nil {
+			return Entry{}, err
+		}
+		if i := sort.SearchStrings(set, member); i == len(set) || set[i] != member {
+			set = append(set, "")
+			copy(set[i+1:], set[i:])
+			set[i] = member
+		}
+		return collection(TypeSet, set)
+	}
+}
+
+// SetRemove returns an Update removing the member from a set value, keys
+// that don't exist are treated as empty sets
+func SetRemove(member string) Update {
+	return func(old Entry, exists bool) (Entry, error) {
+		set, err := members(old, exists, TypeSet)
+		if err != nil {
+			return Entry{}, err
+		}
+		if i := sort.SearchStrings(set, member); i < len(set) && set[i] == member {
+			set = append(set[:i], set[i+1:]...)
+		}
+		return collection(TypeSet, set)
+	}
+}
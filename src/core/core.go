@@ -2,53 +2,436 @@ package core
 
 import (
 	"errors"
-	"os"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Store type is a simple concurrent-safe map
+// Store type is a concurrent-safe keyspace, held by an Engine. Keys are hash
+// partitioned between independently locked shards, so that writes don't block
+// reads and writes of keys in other shards
 type Store struct {
-	sync.RWMutex
-	key []byte
-	m   map[string]string
+	name       string        // Namespace of the store
+	shards     []shard       // Segments of the keyspace, each guarding its keys
+	engine     Engine        // Storage of the store's entries
+	quota      Quota         // Limits applied to writes made to the store
+	evictor    evictor       // Chooses the keys evicted by the quota's policy, nil if none
+	evictions  atomic.Uint64 // Number of keys evicted
+	operations atomic.Bool   // Whether keys are written by typed operations, see NoteOperation
+	mu         sync.Mutex    // Guards keys and size
+	keys       int           // Number of keys held by the store
+	size       int           // Approximate number of bytes held by the store
 }
 
-var store = Store{
-	m:   make(map[string]string),
-	key: []byte(os.Getenv("VILE_SECRET_KEY")),
+// Quota type describes the limits of a store, a zero value
+// for any field means that the limit is not enforced
+type Quota struct {
+	MaxKeys  int            // Maximum number of keys the store may hold
+	MaxBytes int            // Maximum number of key and value bytes the store may hold
+	Eviction EvictionPolicy // Keys evicted to make room for writes exceeding the quota, EvictNone to reject them
 }
 
+// Entry type is a value held by the store along with its metadata
+type Entry struct {
+	Value    string    // Value associated with the key
+	Type     ValueType // Structure of the value, TypeString unless written by a typed operation
+	Modified time.Time // Time the value was last written, zero if unknown
+	Sequence uint64    // Transaction log sequence of the write, zero if unknown
+}
+
+// Commit type is called while a write holds the store's lock, so that writes are
+// logged in the order they are applied, and returns the sequence assigned to
+// the write by the transaction log
+type Commit func() uint64
+
+// ValueCommit type is called like Commit by writes that compute the key's
+// new value while holding the store's lock, and is passed the new value
+type ValueCommit func(value string) uint64
+
+// Update type computes the new value and type of a key from its current entry,
+// if it exists, while the key is locked. Only the Value and Type of the returned
+// entry are used. Returning an error aborts the write
+type Update func(old Entry, exists bool) (Entry, error)
+
+var store = newStore(DefaultNamespace, Quota{})
+
 var ErrNoSuchKey = errors.New("no such key")
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// newStore creates an empty in-memory store of the namespace
+// limited by the provided quota
+func newStore(name string, q Quota) *Store {
+	s, _ := openStore(name, newMemoryEngine(), q)
+	return s
+}
+
+// openStore creates a store of the namespace holding the entries of the
+// engine, limited by the provided quota
+func openStore(name string, engine Engine, q Quota) (*Store, error) {
+	keys, size, err := engine.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read store engine: %w", err)
+	}
+	s := &Store{
+		name:    name,
+		shards:  newShards(),
+		engine:  engine,
+		quota:   q,
+		evictor: newEvictor(q.Eviction),
+		keys:    keys,
+		size:    size,
+	}
+	if s.evictor != nil {
+		// Entries already held by the engine are evicted in key order
+		err = engine.Range("", func(key string, entry Entry) bool {
+			s.evictor.touch(key)
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("cannot read store engine: %w", err)
+		}
+	}
+	return s, nil
+}
 
 // Put adds the provided key value pair into the store
 func Put(key string, value string) error {
-	// Ensure operation is concurrent-safe
-	store.Lock()
-	defer store.Unlock()
-	store.m[key] = value
+	return store.Put(key, value)
+}
+
+// LoadVersions restores the logged versions of each key, oldest first, taking
+// each shard's lock once rather than for each version. Every version is recorded
+// in the key's history and the latest is applied, so the result is the same as
+// loading each version in turn. It is used when replaying the transaction log
+func (s *Store) LoadVersions(versions map[string][]Version) error {
+	byShard := make([][]string, len(s.shards))
+	for key := range versions {
+		i := shardIndex(key)
+		byShard[i] = append(byShard[i], key)
+	}
+	for i, keys := range byShard {
+		if err := s.loadShard(&s.shards[i], keys, versions); err != nil {
+			return err
+		}
+	}
+	if s.evictor == nil {
+		return nil
+	}
+	// Keys are tracked in the order they were last written, so that the least
+	// recently written are evicted first rather than those in map order
+	var written []string
+	for key, vs := range versions {
+		if len(vs) > 0 && !vs[len(vs)-1].Deleted {
+			written = append(written, key)
+		}
+	}
+	sort.Slice(written, func(i, j int) bool {
+		a, b := versions[written[i]], versions[written[j]]
+		return a[len(a)-1].Sequence < b[len(b)-1].Sequence
+	})
+	for _, key := range written {
+		s.evictor.touch(key)
+	}
+	// Evictions weren't necessarily logged, so the store may be over its quota
+	return s.evict("")
+}
+
+// loadShard restores the versions of the keys held by the shard
+func (s *Store) loadShard(sh *shard, keys []string, versions map[string][]Version) error {
+	sh.Lock()
+	defer sh.Unlock()
+	for _, key := range keys {
+		vs := versions[key]
+		if len(vs) == 0 {
+			continue
+		}
+		old, existed, err := s.engine.Get(key)
+		if err != nil {
+			return err
+		}
+		// Deleting a key that doesn't exist isn't recorded, as with LoadDelete
+		exists := existed
+		for _, v := range vs {
+			if v.Deleted && !exists {
+				continue
+			}
+			sh.record(key, v)
+			exists = !v.Deleted
+		}
+		// Keys are loaded out of log order, so the checkpoint isn't advanced, the
+		// next write advances it past the replayed events once they are all loaded
+		latest := vs[len(vs)-1]
+		switch {
+		case !latest.Deleted:
+			err = s.engine.Put(key, latest.Entry, 0)
+		case existed:
+			err = s.engine.Delete(key, 0)
+		}
+		if err != nil {
+			return err
+		}
+		keys, size := 0, 0
+		if existed {
+			keys, size = -1, -len(key)-len(old.Value)
+		}
+		if !latest.Deleted {
+			keys, size = keys+1, size+len(key)+len(latest.Value)
+		}
+		s.adjust(keys, size)
+		// Keys that still exist are tracked by LoadVersions once every shard is loaded
+		if s.evictor != nil && latest.Deleted {
+			s.evictor.remove(key)
+		}
+	}
 	return nil
 }
 
 // Get returns the value associated with the provided key
 // from the store or an error if the key was invalid
 func Get(key string) (string, error) {
+	return store.Get(key)
+}
+
+// Delete removes the value associated with the provided key
+// and returns an error if the deletion was unsuccessful
+func Delete(key string) error {
+	return store.Delete(key)
+}
+
+// Put adds the provided key value pair into the store, or
+// returns ErrQuotaExceeded if doing so would exceed the store's quota
+func (s *Store) Put(key string, value string) error {
+	return s.PutAt(key, value, time.Now(), nil)
+}
+
+// PutAt adds the provided key value pair into the store, recording that it was
+// modified at the provided time. If commit is not nil it is called once the
+// quota has been checked, and the sequence it returns is recorded with the value.
+// If the quota has an eviction policy, keys are evicted to make room for the value
+func (s *Store) PutAt(key string, value string, modified time.Time, commit Commit) error {
+	update := func(Entry, bool) (Entry, error) { return Entry{Value: value}, nil }
+	var valueCommit ValueCommit
+	if commit != nil {
+		valueCommit = func(string) uint64 { return commit() }
+	}
+	_, err := s.UpdateAt(key, update, modified, valueCommit)
+	return err
+}
+
+// UpdateAt atomically replaces the value of the key with the value computed by
+// update from its current entry, returning the new entry. Writes are subject to
+// the quota as with PutAt. If commit is not nil it is called with the new value
+// once the quota has been checked, and the sequence it returns is recorded
+func (s *Store) UpdateAt(key string, update Update, modified time.Time, commit ValueCommit) (Entry, error) {
+	entry, full, err := s.update(key, update, modified, commit)
+	if err != nil || !full {
+		return entry, err
+	}
+	// Keys are evicted once the shard is unlocked, as they may be in other shards
+	return entry, s.evict(key)
+}
+
+// update writes the new value while holding the key's shard lock, reporting
+// whether the store has exceeded its quota and keys must be evicted
+func (s *Store) update(key string, update Update, modified time.Time, commit ValueCommit) (Entry, bool, error) {
 	// Ensure operation is concurrent-safe
-	store.RLock()
-	defer store.RUnlock()
-	// Attempt to get the value from the store
-	value, ok := store.m[key]
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	old, exists, err := s.engine.Get(key)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	next, err := update(old, exists)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	// The change in size is reserved first, as other shards may be written concurrently
+	keys, size := change(key, old, exists, next.Value)
+	full := false
+	if err := s.reserve(keys, size); err != nil {
+		// A value larger than the quota can't be made room for
+		if s.evictor == nil || (s.quota.MaxBytes > 0 && len(key)+len(next.Value) > s.quota.MaxBytes) {
+			return Entry{}, false, err
+		}
+		s.adjust(keys, size)
+		full = true
+	}
+	entry := Entry{Value: next.Value, Type: next.Type, Modified: modified}
+	if commit != nil {
+		entry.Sequence = checkpoints.assign(func() uint64 { return commit(entry.Value) })
+	}
+	if err := s.put(key, entry); err != nil {
+		s.adjust(-keys, -size)
+		return Entry{}, false, err
+	}
+	sh.record(key, Version{Entry: entry})
+	if s.evictor != nil {
+		s.evictor.touch(key)
+	}
+	return entry, full, nil
+}
+
+// Load adds the entry into the store without enforcing the quota, it is used
+// when restoring previously accepted data. If commit is not nil it is called
+// and the sequence it returns is recorded with the entry
+func (s *Store) Load(key string, entry Entry, commit Commit) error {
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	old, exists, err := s.engine.Get(key)
+	if err != nil {
+		return err
+	}
+	if commit != nil {
+		entry.Sequence = checkpoints.assign(commit)
+	}
+	if err := s.put(key, entry); err != nil {
+		return err
+	}
+	s.adjust(change(key, old, exists, entry.Value))
+	sh.record(key, Version{Entry: entry})
+	if s.evictor != nil {
+		s.evictor.touch(key)
+	}
+	return nil
+}
+
+// LoadDelete removes the key from the store, recording the time of the deletion,
+// it is used when restoring previously accepted data. If commit is not nil it is
+// called and the sequence it returns is recorded with the deletion
+func (s *Store) LoadDelete(key string, modified time.Time, commit Commit) error {
+	return s.DeleteAt(key, modified, commit)
+}
+
+// Get returns the value associated with the provided key
+// from the store or an error if the key was invalid
+func (s *Store) Get(key string) (string, error) {
+	entry, err := s.GetEntry(key)
+	return entry.Value, err
+}
+
+// GetEntry returns the value associated with the provided key along
+// with its metadata, or an error if the key was invalid
+func (s *Store) GetEntry(key string) (Entry, error) {
+	// Ensure operation is concurrent-safe
+	sh := s.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	// Attempt to get the entry from the store
+	entry, ok, err := s.engine.Get(key)
+	if err != nil {
+		return Entry{}, err
+	}
 	if !ok {
-		return "", ErrNoSuchKey
+		return Entry{}, ErrNoSuchKey
+	}
+	if s.evictor != nil {
+		s.evictor.touch(key)
 	}
-	return value, nil
+	return entry, nil
 }
 
 // Delete removes the value associated with the provided key
 // and returns an error if the deletion was unsuccessful
-func Delete(key string) error {
+func (s *Store) Delete(key string) error {
+	return s.DeleteAt(key, time.Now(), nil)
+}
+
+// DeleteAt removes the value associated with the provided key, recording that
+// it was deleted at the provided time. If commit is not nil it is called
+// and the sequence it returns is recorded with the deletion
+func (s *Store) DeleteAt(key string, modified time.Time, commit Commit) error {
 	// Ensure operation is concurrent-safe
-	store.Lock()
-	defer store.Unlock()
-	delete(store.m, key)
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	var sequence uint64
+	if commit != nil {
+		sequence = checkpoints.assign(commit)
+	}
+	return s.remove(sh, key, modified, sequence)
+}
+
+// Entries returns a copy of every entry held by the store
+func (s *Store) Entries() (map[string]Entry, error) {
+	defer s.rlockAll()()
+	return s.entries("")
+}
+
+// Scan calls fn for each key starting with the prefix, in key order,
+// until fn returns false. The store cannot be written to until it returns
+func (s *Store) Scan(prefix string, fn func(key string, entry Entry) bool) error {
+	defer s.rlockAll()()
+	return s.engine.Range(prefix, fn)
+}
+
+// Len returns the number of keys held by the store
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys
+}
+
+// Size returns the approximate number of bytes held by the store
+func (s *Store) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// entries returns a copy of every entry with the prefix,
+// the caller must hold every shard's lock
+func (s *Store) entries(prefix string) (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	err := s.engine.Range(prefix, func(key string, entry Entry) bool {
+		entries[key] = entry
+		return true
+	})
+	return entries, err
+}
+
+// remove deletes the key, recording the deletion in the key's history
+// and updating the store size, the caller must hold the shard's write lock
+func (s *Store) remove(sh *shard, key string, modified time.Time, sequence uint64) error {
+	old, ok, err := s.engine.Get(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// Deleting a key that doesn't exist leaves nothing to persist
+		checkpoints.persisted(sequence)
+		return nil
+	}
+	if err := s.engine.Delete(key, checkpoints.checkpoint(sequence)); err != nil {
+		return err
+	}
+	checkpoints.persisted(sequence)
+	s.adjust(-1, -len(key)-len(old.Value))
+	if s.evictor != nil {
+		s.evictor.remove(key)
+	}
+	sh.record(key, Version{Entry: Entry{Modified: modified, Sequence: sequence}, Deleted: true})
 	return nil
 }
+
+// put writes the entry with the engine, recording the checkpoint the entry's
+// sequence allows. The caller must hold the key's shard's write lock
+func (s *Store) put(key string, entry Entry) error {
+	if err := s.engine.Put(key, entry, checkpoints.checkpoint(entry.Sequence)); err != nil {
+		return err
+	}
+	checkpoints.persisted(entry.Sequence)
+	return nil
+}
+
+// change returns the change in the number of keys and bytes held by the
+// store if the old entry of the key, if it exists, is replaced by the value
+func change(key string, old Entry, exists bool, value string) (int, int) {
+	if exists {
+		return 0, len(value) - len(old.Value)
+	}
+	return 1, len(key) + len(value)
+}
@@ -2,7 +2,10 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestPut uses table-driven testing to test a variety
@@ -91,3 +94,494 @@ func TestCoreIntegration(t *testing.T) {
 	}
 
 }
+
+// TestCoreNamespaces tests that namespaces have isolated
+// keyspaces and that their quotas are enforced
+func TestCoreNamespaces(t *testing.T) {
+	ns, err := CreateNamespace("core-test", NamespaceOptions{
+		Token: "secret",
+		Quota: Quota{MaxKeys: 2},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while creating namespace: %q", err)
+	}
+	if _, err := CreateNamespace("core-test", NamespaceOptions{}); !errors.Is(err, ErrNamespaceExists) {
+		t.Fatalf("expected %q while recreating namespace, instead got %q", ErrNamespaceExists, err)
+	}
+	// Keys in the namespace should not be visible in the default namespace
+	if err := ns.Put("key1", "val1"); err != nil {
+		t.Fatalf("unexpected error while PUTting object: %q", err)
+	}
+	if _, err := Get("key1"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("expected %q from default namespace, instead got %q", ErrNoSuchKey, err)
+	}
+	// Overwriting a key should not count against the quota
+	for _, key := range []string{"key1", "key2"} {
+		if err := ns.Put(key, "val2"); err != nil {
+			t.Fatalf("unexpected error while PUTting object: %q", err)
+		}
+	}
+	if err := ns.Put("key3", "val3"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected %q, instead got %q", ErrQuotaExceeded, err)
+	}
+	// Only the configured token should be authorized
+	if Authorize("core-test", "wrong") || !Authorize("core-test", "secret") {
+		t.Fatal("namespace token was not enforced")
+	}
+}
+
+// TestCoreEncryption tests that values can be encrypted and
+// decrypted across a key rotation
+func TestCoreEncryption(t *testing.T) {
+	defer SetEncryptionKeys("")
+	if err := SetEncryptionKeys("old-secret"); err != nil {
+		t.Fatal(err)
+	}
+	sealed, oldID, err := Encrypt("val1")
+	if err != nil {
+		t.Fatalf("unexpected error while encrypting: %q", err)
+	}
+	if sealed == "val1" || oldID == "" {
+		t.Fatalf("expected value to be encrypted, instead got %q (key %q)", sealed, oldID)
+	}
+	// Rotate the key, values sealed with the old key must remain readable
+	if err := SetEncryptionKeys("new-secret", "old-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, newID, _ := Encrypt("val2"); newID == oldID {
+		t.Fatalf("expected new key ID after rotation, instead got %q", newID)
+	}
+	opened, err := Decrypt(sealed, oldID)
+	if err != nil {
+		t.Fatalf("unexpected error while decrypting: %q", err)
+	}
+	if opened != "val1" {
+		t.Fatalf("expected %q, instead got %q", "val1", opened)
+	}
+	// Once the old key is retired its values cannot be read
+	if err := SetEncryptionKeys("new-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(sealed, oldID); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Fatalf("expected %q, instead got %q", ErrUnknownEncryptionKey, err)
+	}
+}
+
+func TestCoreHistory(t *testing.T) {
+	SetHistoryRetention(2)
+	defer SetHistoryRetention(DefaultHistoryRetention)
+	s := newStore(DefaultNamespace, Quota{})
+	seq := uint64(0)
+	commit := func() uint64 { seq++; return seq }
+	for _, value := range []string{"v1", "v2", "v3"} {
+		if err := s.PutAt("key", value, time.Now(), commit); err != nil {
+			t.Fatalf("unexpected error while PUTting object: %q", err)
+		}
+	}
+	if err := s.DeleteAt("key", time.Now(), commit); err != nil {
+		t.Fatalf("unexpected error while DELETEing object: %q", err)
+	}
+	// Only the most recent versions should be retained
+	versions, err := s.History("key")
+	if err != nil {
+		t.Fatalf("unexpected error while getting history: %q", err)
+	}
+	if len(versions) != 2 || versions[0].Value != "v3" || versions[0].Sequence != 3 || !versions[1].Deleted {
+		t.Fatalf("unexpected history: %+v", versions)
+	}
+	if v, err := s.GetVersion("key", 3); err != nil || v.Value != "v3" {
+		t.Fatalf("expected version 3 to be v3, instead got %+v, %v", v, err)
+	}
+	if _, err := s.GetVersion("key", 1); !errors.Is(err, ErrNoSuchVersion) {
+		t.Fatalf("expected %q, instead got %q", ErrNoSuchVersion, err)
+	}
+	if _, err := s.History("missing"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatalf("expected %q, instead got %q", ErrNoSuchKey, err)
+	}
+	// The history of deleted keys is dropped once the tombstone retention passes
+	SetTombstoneRetention(0)
+	defer SetTombstoneRetention(DefaultTombstoneRetention)
+	for i := 0; i < 3*shardCount; i++ {
+		key := fmt.Sprint("churn-", i)
+		s.Put(key, "value")
+		s.Delete(key)
+	}
+	for i := 0; i < 3*shardCount; i++ {
+		s.Put(fmt.Sprint("churn-", i), "value")
+	}
+	if _, err := s.History("churn-0"); err != nil {
+		t.Fatalf("expected churn-0 to have been written again, instead got %q", err)
+	}
+	kept := 0
+	for i := range s.shards {
+		kept += len(s.shards[i].history)
+	}
+	if versions, _ := s.History("churn-0"); len(versions) != 1 || kept != 3*shardCount {
+		t.Fatalf("expected only the new versions to be kept, instead got %+v and %d keys", versions, kept)
+	}
+}
+
+// countingEngine counts the reads made of an in-memory engine
+type countingEngine struct {
+	memoryEngine
+	gets int
+}
+
+func (c *countingEngine) Get(key string) (Entry, bool, error) {
+	c.gets++
+	return c.memoryEngine.Get(key)
+}
+
+func TestCoreEngine(t *testing.T) {
+	counter := &countingEngine{memoryEngine: newMemoryEngine()}
+	s, err := openStore(DefaultNamespace, NewCachedEngine(counter, 2), Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		if err := s.Put(key, "val"); err != nil {
+			t.Fatalf("unexpected error while PUTting object: %q", err)
+		}
+	}
+	// Only the two most recently written keys should be cached
+	counter.gets = 0
+	for _, key := range []string{"a/2", "b/1", "a/1"} {
+		if _, err := s.Get(key); err != nil {
+			t.Fatalf("unexpected error while GETting object: %q", err)
+		}
+	}
+	if counter.gets != 1 {
+		t.Errorf("expected 1 uncached read, instead got %d", counter.gets)
+	}
+	// Scans should only visit keys with the prefix, in order
+	keys := []string{}
+	err = s.Scan("a/", func(key string, entry Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil || len(keys) != 2 || keys[0] != "a/1" || keys[1] != "a/2" {
+		t.Errorf("unexpected scan result %v (%v)", keys, err)
+	}
+	if s.Len() != 3 {
+		t.Errorf("expected 3 keys, instead got %d", s.Len())
+	}
+}
+
+func TestCoreShards(t *testing.T) {
+	// The quota should hold while shards are written concurrently
+	s := newStore(DefaultNamespace, Quota{MaxKeys: 100})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.Put(fmt.Sprintf("key-%d-%d", i, j), "value")
+			}
+		}(i)
+	}
+	wg.Wait()
+	entries, err := s.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 100 || len(entries) != 100 {
+		t.Errorf("expected 100 keys, instead got %d (%d entries)", s.Len(), len(entries))
+	}
+	if s.Size() != sizeOf(entries) {
+		t.Errorf("expected size %d, instead got %d", sizeOf(entries), s.Size())
+	}
+}
+
+// sizeOf returns the number of key and value bytes of the entries
+func sizeOf(entries map[string]Entry) int {
+	size := 0
+	for key, entry := range entries {
+		size += len(key) + len(entry.Value)
+	}
+	return size
+}
+
+// benchmarkKeys are the keys read and written by the benchmarks, run them
+// with -cpu to compare throughput across GOMAXPROCS, e.g. -cpu 1,2,4,8
+var benchmarkKeys = func() []string {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}()
+
+// benchmarkStore returns a store holding every benchmark key
+func benchmarkStore(b *testing.B) *Store {
+	s := newStore(DefaultNamespace, Quota{})
+	for _, key := range benchmarkKeys {
+		if err := s.Put(key, "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	return s
+}
+
+// benchmarkParallel cycles every goroutine through the benchmark keys, putting
+// the key on writes out of every 100 operations and getting it otherwise
+func benchmarkParallel(b *testing.B, writes int) {
+	s := benchmarkStore(b)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := benchmarkKeys[i%len(benchmarkKeys)]
+			if i%100 < writes {
+				s.Put(key, "value")
+			} else {
+				s.Get(key)
+			}
+			i += 7
+		}
+	})
+}
+
+func BenchmarkStoreGet(b *testing.B) {
+	benchmarkParallel(b, 0)
+}
+
+func BenchmarkStorePut(b *testing.B) {
+	benchmarkParallel(b, 100)
+}
+
+func BenchmarkStoreMixed(b *testing.B) {
+	benchmarkParallel(b, 10)
+}
+
+func TestCoreEviction(t *testing.T) {
+	var logged []string
+	SetEvictionHook(func(ns, key string, modified time.Time) uint64 {
+		logged = append(logged, ns+"/"+key)
+		return 0
+	})
+	defer SetEvictionHook(nil)
+	testCases := map[EvictionPolicy]string{
+		// b is the least recently used after a is read
+		EvictLRU: "b",
+		// c is used least often, as a and b are read
+		EvictLFU: "c",
+	}
+	for policy, evicted := range testCases {
+		logged = nil
+		s := newStore("cache", Quota{MaxKeys: 3, MaxBytes: 16, Eviction: policy})
+		for _, key := range []string{"a", "b", "c"} {
+			if err := s.Put(key, "1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Get("a")
+		if policy == EvictLFU {
+			s.Get("b")
+		}
+		if err := s.Put("d", "1"); err != nil {
+			t.Fatalf("%s: unexpected error %v", policy, err)
+		}
+		if _, err := s.Get(evicted); !errors.Is(err, ErrNoSuchKey) {
+			t.Errorf("%s: expected %s to be evicted, got %v", policy, evicted, err)
+		}
+		if s.Len() != 3 || s.Evictions() != 1 || len(logged) != 1 || logged[0] != "cache/"+evicted {
+			t.Errorf("%s: unexpected %d keys, %d evictions, logged %v", policy, s.Len(), s.Evictions(), logged)
+		}
+		// The history of evicted keys isn't kept
+		if _, err := s.History(evicted); !errors.Is(err, ErrNoSuchKey) {
+			t.Errorf("%s: expected the history of %s to be dropped, got %v", policy, evicted, err)
+		}
+		// Making room for a large value evicts several keys
+		if err := s.Put("e", "1234567890"); err != nil || s.Size() > 16 {
+			t.Errorf("%s: expected keys to be evicted for e, got size %d (%v)", policy, s.Size(), err)
+		}
+		// Values larger than the quota are still rejected
+		if err := s.Put("f", "12345678901234567890"); !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("%s: expected %q, instead got %v", policy, ErrQuotaExceeded, err)
+		}
+	}
+	// Replayed keys are evicted in the order they were last written
+	s := newStore("cache", Quota{MaxKeys: 2, Eviction: EvictLRU})
+	versions := map[string][]Version{}
+	for i, key := range []string{"b", "c", "a"} {
+		versions[key] = []Version{{Entry: Entry{Value: "1", Sequence: uint64(i + 1)}}}
+	}
+	if err := s.LoadVersions(versions); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("b"); !errors.Is(err, ErrNoSuchKey) || s.Len() != 2 {
+		t.Errorf("expected b to be evicted after replaying, got %d keys (%v)", s.Len(), err)
+	}
+}
+
+// TestCoreCheckpoints checks that writes persisted out of order don't record
+// a checkpoint past a sequence that is yet to be persisted
+func TestCoreCheckpoints(t *testing.T) {
+	c := newCheckpointTracker()
+	for seq := uint64(1); seq <= 4; seq++ {
+		c.assign(func() uint64 { return seq })
+	}
+	// Write 2 is persisted before write 1
+	if cp := c.checkpoint(2); cp != 0 {
+		t.Errorf("expected write 2 not to advance the checkpoint past 1, instead got %d", cp)
+	}
+	c.persisted(2)
+	if cp := c.checkpoint(1); cp != 2 {
+		t.Errorf("expected checkpoint 2, instead got %d", cp)
+	}
+	c.persisted(1)
+	// Write 3 fails, so later writes stay below it
+	if cp := c.checkpoint(4); cp != 2 {
+		t.Errorf("expected checkpoint 2 while 3 is pending, instead got %d", cp)
+	}
+	c.persisted(4)
+	if cp := c.checkpoint(c.assign(func() uint64 { return 5 })); cp != 2 {
+		t.Errorf("expected checkpoint 2 while 3 is pending, instead got %d", cp)
+	}
+	// Writes without a sequence leave the checkpoint as it is
+	if cp := c.checkpoint(0); cp != 0 {
+		t.Errorf("expected checkpoint 0 without a sequence, instead got %d", cp)
+	}
+	// A write being assigned a sequence holds back the writes assigned after it
+	c = newCheckpointTracker()
+	c.assign(func() uint64 {
+		if cp := c.checkpoint(c.assign(func() uint64 { return 2 })); cp != 0 {
+			t.Errorf("expected write 2 not to advance the checkpoint past 1, instead got %d", cp)
+		}
+		return 1
+	})
+	if cp := c.checkpoint(1); cp != 1 {
+		t.Errorf("expected checkpoint 1, instead got %d", cp)
+	}
+}
+
+func TestCoreIncrement(t *testing.T) {
+	s := newStore(DefaultNamespace, Quota{})
+	if e, err := s.UpdateAt("n", Increment(5), time.Now(), nil); err != nil || e.Value != "5" {
+		t.Errorf("expected 5, instead got %q (%v)", e.Value, err)
+	}
+	if e, err := s.UpdateAt("n", Increment(-7), time.Now(), nil); err != nil || e.Value != "-2" {
+		t.Errorf("expected -2, instead got %q (%v)", e.Value, err)
+	}
+	s.Put("max", "9223372036854775807")
+	if _, err := s.UpdateAt("max", Increment(1), time.Now(), nil); !errors.Is(err, ErrOverflow) {
+		t.Errorf("expected %q, instead got %v", ErrOverflow, err)
+	}
+	s.Put("text", "abc")
+	if _, err := s.UpdateAt("text", Increment(1), time.Now(), nil); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("expected %q, instead got %v", ErrNotInteger, err)
+	}
+	// Failed updates don't change the value
+	if v, _ := s.Get("text"); v != "abc" {
+		t.Errorf("expected abc to be unchanged, instead got %q", v)
+	}
+}
+
+func TestCoreCollections(t *testing.T) {
+	s := newStore(DefaultNamespace, Quota{})
+	update := func(key string, u Update) (Entry, error) {
+		return s.UpdateAt(key, u, time.Now(), nil)
+	}
+	if e, err := update("s", Append("ab")); err != nil || e.Value != "ab" {
+		t.Errorf("expected ab, instead got %q (%v)", e.Value, err)
+	}
+	if e, err := update("s", Append("c")); err != nil || e.Value != "abc" {
+		t.Errorf("expected abc, instead got %q (%v)", e.Value, err)
+	}
+	// Lists keep their order and type
+	update("l", Push("b", false))
+	update("l", Push("c", false))
+	e, err := update("l", Push("a", true))
+	if err != nil || e.Type != TypeList || e.Value != `["a","b","c"]` {
+		t.Errorf("expected list [a b c], instead got %s %q (%v)", e.Type, e.Value, err)
+	}
+	var popped string
+	if _, err := update("l", Pop(false, &popped)); err != nil || popped != "c" {
+		t.Errorf("expected c to be popped, instead got %q (%v)", popped, err)
+	}
+	if _, err := update("l", Pop(true, &popped)); err != nil || popped != "a" {
+		t.Errorf("expected a to be popped, instead got %q (%v)", popped, err)
+	}
+	update("l", Pop(true, &popped))
+	if _, err := update("l", Pop(true, &popped)); !errors.Is(err, ErrEmptyList) {
+		t.Errorf("expected %q, instead got %v", ErrEmptyList, err)
+	}
+	if _, err := update("missing", Pop(true, &popped)); !errors.Is(err, ErrNoSuchKey) {
+		t.Errorf("expected %q, instead got %v", ErrNoSuchKey, err)
+	}
+	// Sets are sorted and hold each member once
+	for _, member := range []string{"b", "a", "b", "c"} {
+		update("set", SetAdd(member))
+	}
+	e, err = update("set", SetRemove("c"))
+	if err != nil || e.Type != TypeSet || e.Value != `["a","b"]` {
+		t.Errorf("expected set [a b], instead got %s %q (%v)", e.Type, e.Value, err)
+	}
+	if members, err := e.Members(); err != nil || len(members) != 2 {
+		t.Errorf("expected 2 members, instead got %v (%v)", members, err)
+	}
+	// Operations on values of another type fail without changing them
+	wrong := []struct {
+		key    string
+		update Update
+	}{{"s", Push("x", false)}, {"l", SetAdd("x")}, {"set", Append("x")}, {"set", Increment(1)}}
+	for _, w := range wrong {
+		if _, err := update(w.key, w.update); !errors.Is(err, ErrWrongType) {
+			t.Errorf("%s: expected %q, instead got %v", w.key, ErrWrongType, err)
+		}
+	}
+	if e, _ := s.GetEntry("s"); e.Type != TypeString || e.Value != "abc" {
+		t.Errorf("expected string abc to be unchanged, instead got %s %q", e.Type, e.Value)
+	}
+	// Putting a value replaces a list with a string
+	s.Put("l", "plain")
+	if e, _ := s.GetEntry("l"); e.Type != TypeString {
+		t.Errorf("expected a string, instead got %s", e.Type)
+	}
+}
+
+func TestCoreHashes(t *testing.T) {
+	s := newStore(DefaultNamespace, Quota{})
+	// Concurrent writes to different fields don't overwrite each other
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.UpdateAt("h", HashSet(fmt.Sprint("f", i), fmt.Sprint(i)), time.Now(), nil); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	e, err := s.GetEntry("h")
+	if err != nil || e.Type != TypeHash {
+		t.Fatalf("expected a hash, instead got %s (%v)", e.Type, err)
+	}
+	if fields, err := e.Fields(); err != nil || len(fields) != 20 {
+		t.Errorf("expected 20 fields, instead got %d (%v)", len(fields), err)
+	}
+	if v, err := e.Field("f7"); err != nil || v != "7" {
+		t.Errorf("expected 7, instead got %q (%v)", v, err)
+	}
+	if _, err := s.UpdateAt("h", HashDelete("f7"), time.Now(), nil); err != nil {
+		t.Error(err)
+	}
+	e, _ = s.GetEntry("h")
+	if _, err := e.Field("f7"); !errors.Is(err, ErrNoSuchField) {
+		t.Errorf("expected %q, instead got %v", ErrNoSuchField, err)
+	}
+	if _, err := s.UpdateAt("h", HashDelete("f7"), time.Now(), nil); !errors.Is(err, ErrNoSuchField) {
+		t.Errorf("expected %q, instead got %v", ErrNoSuchField, err)
+	}
+	// Hashes are encoded in field order
+	s.UpdateAt("small", HashSet("b", "2"), time.Now(), nil)
+	if e, _ := s.UpdateAt("small", HashSet("a", "1"), time.Now(), nil); e.Value != `{"a":"1","b":"2"}` {
+		t.Errorf("expected sorted fields, instead got %q", e.Value)
+	}
+	s.Put("str", "plain")
+	if _, err := s.UpdateAt("str", HashSet("a", "1"), time.Now(), nil); !errors.Is(err, ErrWrongType) {
+		t.Errorf("expected %q, instead got %v", ErrWrongType, err)
+	}
+}
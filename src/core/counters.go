@@ -0,0 +1,33 @@
+package core
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var ErrNotInteger = errors.New("value is not an integer")
+var ErrOverflow = errors.New("integer overflow")
+
+// Increment returns an Update adding by to the integer value of a key, keys
+// that don't exist are treated as 0. It returns ErrWrongType if the value isn't
+// a string, ErrNotInteger if it isn't a base 10 integer, or ErrOverflow if the
+// result would overflow
+func Increment(by int64) Update {
+	return func(old Entry, exists bool) (Entry, error) {
+		var n int64
+		if exists {
+			if old.Type != TypeString {
+				return Entry{}, ErrWrongType
+			}
+			var err error
+			if n, err = strconv.ParseInt(old.Value, 10, 64); err != nil {
+				return Entry{}, ErrNotInteger
+			}
+		}
+		if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+			return Entry{}, ErrOverflow
+		}
+		return Entry{Value: strconv.FormatInt(n+by, 10)}, nil
+	}
+}
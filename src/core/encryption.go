@@ -0,0 +1,137 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+
+// keyring type holds the keys used to encrypt values at rest, new values are
+// encrypted with the current key while previous keys remain available for
+// decrypting values written before the key was rotated
+type keyring struct {
+	sync.RWMutex
+	current string                 // ID of the key used for encryption, empty if disabled
+	keys    map[string]cipher.AEAD // Keys indexed by ID
+}
+
+// keys is loaded from VILE_SECRET_KEY, with rotated keys listed
+// in the comma-separated VILE_PREVIOUS_SECRET_KEYS
+var keys = newKeyring()
+
+func newKeyring() *keyring {
+	k := &keyring{}
+	previous := strings.Split(os.Getenv("VILE_PREVIOUS_SECRET_KEYS"), ",")
+	if err := k.set(os.Getenv("VILE_SECRET_KEY"), previous...); err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// SetEncryptionKeys replaces the keys used to encrypt values at rest, values are
+// encrypted with the current secret and can be decrypted with any of the secrets.
+// An empty current secret disables encryption of new values
+func SetEncryptionKeys(current string, previous ...string) error {
+	return keys.set(current, previous...)
+}
+
+// EncryptionEnabled reports whether new values are encrypted at rest
+func EncryptionEnabled() bool {
+	keys.RLock()
+	defer keys.RUnlock()
+	return keys.current != ""
+}
+
+// Encrypt seals the value with the current key using AES-GCM and returns the
+// encoded ciphertext along with the ID of the key used. If encryption is
+// disabled the value is returned unchanged with an empty key ID
+func Encrypt(value string) (string, string, error) {
+	keys.RLock()
+	defer keys.RUnlock()
+	if keys.current == "" {
+		return value, "", nil
+	}
+	aead := keys.keys[keys.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", fmt.Errorf("cannot generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(keys.current))
+	return base64.StdEncoding.EncodeToString(sealed), keys.current, nil
+}
+
+// Decrypt opens a value sealed by Encrypt with the key of the provided ID, values
+// with an empty key ID were stored unencrypted and are returned unchanged
+func Decrypt(value string, keyID string) (string, error) {
+	if keyID == "" {
+		return value, nil
+	}
+	keys.RLock()
+	aead, ok := keys.keys[keyID]
+	keys.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("cannot decode encrypted value: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// set replaces the keys of the keyring
+func (k *keyring) set(current string, previous ...string) error {
+	aeads := make(map[string]cipher.AEAD)
+	currentID := ""
+	for i, secret := range append([]string{current}, previous...) {
+		if secret == "" {
+			continue
+		}
+		id, aead, err := deriveKey(secret)
+		if err != nil {
+			return err
+		}
+		aeads[id] = aead
+		if i == 0 {
+			currentID = id
+		}
+	}
+	k.Lock()
+	defer k.Unlock()
+	k.current, k.keys = currentID, aeads
+	return nil
+}
+
+// deriveKey creates an AES-256-GCM cipher from a secret, identified by
+// a fingerprint of the key so that the secret itself is never stored
+func deriveKey(secret string) (string, cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	fingerprint := sha256.Sum256(key[:])
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+	return hex.EncodeToString(fingerprint[:4]), aead, nil
+}
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Engine interface defines the storage of a single namespace's entries. A key is
+// only written while its shard of the store is locked, but other keys may be read
+// and written concurrently, so engines must be safe for concurrent use
+type Engine interface {
+	Get(key string) (Entry, bool, error)                              // Get returns the entry of the key and whether it exists
+	Put(key string, entry Entry, checkpoint uint64) error             // Put writes the entry of the key, advancing the checkpoint if it is later
+	Delete(key string, checkpoint uint64) error                       // Delete removes the key, advancing the checkpoint if it is later
+	Range(prefix string, fn func(key string, entry Entry) bool) error // Range calls fn for each key with the prefix in key order until it returns false
+	Stats() (keys int, bytes int, err error)                          // Stats returns the number of keys and key and value bytes held
+}
+
+// Backend interface creates the engines of each namespace
+type Backend interface {
+	Engine(namespace string) (Engine, error) // Engine opens the engine holding the namespace's entries
+	Checkpoint() (uint64, error)             // Checkpoint returns the sequence every earlier write was persisted by, 0 if not durable
+	Close() error                            // Close releases the backend's resources
+}
+
+// backend creates the engines of new namespaces, it is guarded by the namespaces lock
+var backend Backend = memoryBackend{}
+
+// SetBackend replaces the store of every namespace with one held by the
+// backend's engines. It must be called before the stores are used
+func SetBackend(b Backend) error {
+	namespaces.Lock()
+	defer namespaces.Unlock()
+	stores := make(map[string]*Store, len(namespaces.m))
+	for name, ns := range namespaces.m {
+		engine, err := b.Engine(name)
+		if err != nil {
+			return err
+		}
+		if stores[name], err = openStore(name, engine, ns.opts.Quota); err != nil {
+			return err
+		}
+	}
+	for name, ns := range namespaces.m {
+		ns.store = stores[name]
+	}
+	store = stores[DefaultNamespace]
+	backend = b
+	return nil
+}
+
+// Checkpoint returns the transaction log sequence that every earlier write has been
+// persisted by, events up to it don't need to be replayed. It is 0 for the in-memory backend
+func Checkpoint() (uint64, error) {
+	namespaces.RLock()
+	defer namespaces.RUnlock()
+	return backend.Checkpoint()
+}
+
+// Durable reports whether the backend persists entries itself, so that
+// they don't need to be rebuilt from the transaction log
+func Durable() bool {
+	namespaces.RLock()
+	defer namespaces.RUnlock()
+	_, inMemory := backend.(memoryBackend)
+	return !inMemory
+}
+
+// memoryBackend type holds every namespace in memory
+type memoryBackend struct{}
+
+// Engine method returns a new in-memory engine
+func (memoryBackend) Engine(string) (Engine, error) {
+	return newMemoryEngine(), nil
+}
+
+// Checkpoint method returns 0, as nothing is persisted
+func (memoryBackend) Checkpoint() (uint64, error) {
+	return 0, nil
+}
+
+// Close method does nothing
+func (memoryBackend) Close() error {
+	return nil
+}
+
+// memoryEngine type holds entries in maps partitioned like the shards of a
+// store, each with its own lock, so that shards can be written concurrently
+type memoryEngine struct {
+	segments []memorySegment
+}
+
+// memorySegment type holds the entries of the keys of a single shard
+type memorySegment struct {
+	sync.RWMutex
+	m map[string]Entry
+}
+
+// newMemoryEngine creates an empty in-memory engine
+func newMemoryEngine() memoryEngine {
+	segments := make([]memorySegment, shardCount)
+	for i := range segments {
+		segments[i].m = make(map[string]Entry)
+	}
+	return memoryEngine{segments: segments}
+}
+
+// segment returns the segment holding the key
+func (m memoryEngine) segment(key string) *memorySegment {
+	return &m.segments[shardIndex(key)]
+}
+
+// Get method returns the entry of the key
+func (m memoryEngine) Get(key string) (Entry, bool, error) {
+	seg := m.segment(key)
+	seg.RLock()
+	defer seg.RUnlock()
+	entry, ok := seg.m[key]
+	return entry, ok, nil
+}
+
+// Put method writes the entry of the key
+func (m memoryEngine) Put(key string, entry Entry, checkpoint uint64) error {
+	seg := m.segment(key)
+	seg.Lock()
+	defer seg.Unlock()
+	seg.m[key] = entry
+	return nil
+}
+
+// Delete method removes the key
+func (m memoryEngine) Delete(key string, checkpoint uint64) error {
+	seg := m.segment(key)
+	seg.Lock()
+	defer seg.Unlock()
+	delete(seg.m, key)
+	return nil
+}
+
+// Range method calls fn for each key with the prefix in key order, the
+// matching entries are copied first so that fn may write to the engine
+func (m memoryEngine) Range(prefix string, fn func(key string, entry Entry) bool) error {
+	entries := make(map[string]Entry)
+	for i := range m.segments {
+		seg := &m.segments[i]
+		seg.RLock()
+		for key, entry := range seg.m {
+			if strings.HasPrefix(key, prefix) {
+				entries[key] = entry
+			}
+		}
+		seg.RUnlock()
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !fn(key, entries[key]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Stats method returns the number of keys and bytes held
+func (m memoryEngine) Stats() (int, int, error) {
+	keys, size := 0, 0
+	for i := range m.segments {
+		seg := &m.segments[i]
+		seg.RLock()
+		for key, entry := range seg.m {
+			size += len(key) + len(entry.Value)
+		}
+		keys += len(seg.m)
+		seg.RUnlock()
+	}
+	return keys, size, nil
+}
+
+// cachedEngine type keeps the most recently read entries of
+// another engine in memory, writing through to the engine
+type cachedEngine struct {
+	Engine
+	mu      sync.Mutex
+	max     int                      // Maximum number of cached entries
+	order   *list.List               // Cached keys, most recently used first
+	entries map[string]*list.Element // Cached entries by key
+}
+
+// cachedEntry type is a single entry in a cachedEngine
+type cachedEntry struct {
+	key   string
+	entry Entry
+}
+
+// NewCachedEngine wraps the engine with a read cache holding up to max
+// entries, evicting the least recently used. The wrapped engine must
+// not be modified except through the returned engine
+func NewCachedEngine(e Engine, max int) Engine {
+	return &cachedEngine{Engine: e, max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Get method returns the entry from the cache, reading it from the engine on a miss
+func (c *cachedEngine) Get(key string) (Entry, bool, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cachedEntry).entry, true, nil
+	}
+	c.mu.Unlock()
+	entry, ok, err := c.Engine.Get(key)
+	if ok && err == nil {
+		c.cache(key, entry)
+	}
+	return entry, ok, err
+}
+
+// Put method writes the entry to the engine and the cache
+func (c *cachedEngine) Put(key string, entry Entry, checkpoint uint64) error {
+	if err := c.Engine.Put(key, entry, checkpoint); err != nil {
+		c.evict(key)
+		return err
+	}
+	c.cache(key, entry)
+	return nil
+}
+
+// Delete method removes the key from the engine and the cache
+func (c *cachedEngine) Delete(key string, checkpoint uint64) error {
+	c.evict(key)
+	return c.Engine.Delete(key, checkpoint)
+}
+
+// cache adds the entry to the cache, evicting the least recently used entry if full
+func (c *cachedEngine) cache(key string, entry Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cachedEntry).entry = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedEntry{key: key, entry: entry})
+	if c.order.Len() > c.max {
+		oldest := c.order.Remove(c.order.Back()).(*cachedEntry)
+		delete(c.entries, oldest.key)
+	}
+}
+
+// evict removes the key from the cache
+func (c *cachedEngine) evict(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
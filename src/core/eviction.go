@@ -0,0 +1,287 @@
+package core
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy type selects which keys are evicted when a write would exceed
+// a store's quota, turning the store into a cache rather than rejecting the write
+type EvictionPolicy string
+
+const (
+	EvictNone EvictionPolicy = ""    // Writes exceeding the quota are rejected
+	EvictLRU  EvictionPolicy = "lru" // The least recently used keys are evicted
+	EvictLFU  EvictionPolicy = "lfu" // The least frequently used keys are evicted
+)
+
+// ParseEvictionPolicy returns the policy with the provided name
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch p := EvictionPolicy(name); p {
+	case EvictNone, EvictLRU, EvictLFU:
+		return p, nil
+	}
+	return EvictNone, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// EvictionHook type is called while a key is being evicted from a namespace,
+// and returns the sequence the transaction log assigned to the eviction
+type EvictionHook func(namespace, key string, modified time.Time) uint64
+
+// evictionHook is called for each eviction if set, evictions aren't logged otherwise
+var evictionHook atomic.Pointer[EvictionHook]
+
+// SetEvictionHook sets the function called for each evicted key, so that
+// evictions can be logged as deletions, or clears it if h is nil
+func SetEvictionHook(h EvictionHook) {
+	if h == nil {
+		evictionHook.Store(nil)
+		return
+	}
+	evictionHook.Store(&h)
+}
+
+// NoteOperation records that keys of the store are written by typed operations,
+// which are replayed against the key's earlier value, so evictions from the
+// store need to be logged for the replay to give the same result
+func (s *Store) NoteOperation() {
+	s.operations.Store(true)
+}
+
+// Operations reports whether keys of the store are written by typed operations
+func (s *Store) Operations() bool {
+	return s.operations.Load()
+}
+
+// Evictions returns the number of keys evicted from the store
+func (s *Store) Evictions() uint64 {
+	return s.evictions.Load()
+}
+
+// evictor interface tracks the use of a store's keys to choose which to evict,
+// implementations must be safe for concurrent use
+type evictor interface {
+	touch(key string)                    // touch records a read or write of the key
+	remove(key string)                   // remove stops tracking the key
+	tracked(key string) bool             // tracked reports whether the key is tracked
+	victim(except string) (string, bool) // victim stops tracking and returns the next key to evict
+}
+
+// newEvictor creates the evictor of the policy, or nil if keys aren't evicted
+func newEvictor(p EvictionPolicy) evictor {
+	switch p {
+	case EvictLRU:
+		return &lruEvictor{order: list.New(), keys: make(map[string]*list.Element)}
+	case EvictLFU:
+		return &lfuEvictor{keys: make(map[string]*lfuItem)}
+	}
+	return nil
+}
+
+// over reports whether the store holds more than its quota allows
+func (s *Store) over() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return (s.quota.MaxKeys > 0 && s.keys > s.quota.MaxKeys) ||
+		(s.quota.MaxBytes > 0 && s.size > s.quota.MaxBytes)
+}
+
+// evict removes the keys chosen by the eviction policy, other than the
+// excepted key, until the store is within its quota. It must be called
+// without holding any shard's lock
+func (s *Store) evict(except string) error {
+	for s.over() {
+		key, ok := s.evictor.victim(except)
+		if !ok {
+			return nil
+		}
+		if err := s.evictKey(key); err != nil {
+			return fmt.Errorf("cannot evict key: %w", err)
+		}
+	}
+	return nil
+}
+
+// evictKey removes the key, unless it has been used since it was chosen
+func (s *Store) evictKey(key string) error {
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	if s.evictor.tracked(key) {
+		return nil
+	}
+	if _, ok, err := s.engine.Get(key); err != nil || !ok {
+		return err
+	}
+	modified := time.Now()
+	var sequence uint64
+	if h := evictionHook.Load(); h != nil {
+		sequence = checkpoints.assign(func() uint64 { return (*h)(s.name, key, modified) })
+	}
+	if err := s.remove(sh, key, modified, sequence); err != nil {
+		return err
+	}
+	// Evicted keys don't keep their history, which would otherwise be held
+	// outside of the quota for as long as the key isn't written again
+	sh.forget(key)
+	s.evictions.Add(1)
+	return nil
+}
+
+// lruEvictor type evicts the least recently used keys
+type lruEvictor struct {
+	mu    sync.Mutex
+	order *list.List               // Keys, most recently used first
+	keys  map[string]*list.Element // Elements of each key
+}
+
+// touch method moves the key to the front of the order
+func (e *lruEvictor) touch(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.keys[key]; ok {
+		e.order.MoveToFront(el)
+		return
+	}
+	e.keys[key] = e.order.PushFront(key)
+}
+
+// remove method stops tracking the key
+func (e *lruEvictor) remove(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if el, ok := e.keys[key]; ok {
+		e.order.Remove(el)
+		delete(e.keys, key)
+	}
+}
+
+// tracked method reports whether the key is tracked
+func (e *lruEvictor) tracked(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.keys[key]
+	return ok
+}
+
+// victim method removes and returns the least recently used key
+func (e *lruEvictor) victim(except string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for el := e.order.Back(); el != nil; el = el.Prev() {
+		if key := el.Value.(string); key != except {
+			e.order.Remove(el)
+			delete(e.keys, key)
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// lfuEvictor type evicts the least frequently used keys,
+// breaking ties by evicting the least recently used
+type lfuEvictor struct {
+	mu    sync.Mutex
+	heap  lfuHeap             // Keys, least frequently used first
+	keys  map[string]*lfuItem // Items of each key
+	clock uint64              // Incremented on each use to order ties
+}
+
+// lfuItem type is the use of a single key
+type lfuItem struct {
+	key   string
+	count uint64 // Number of times the key has been used
+	last  uint64 // Clock of the last use
+	index int    // Position in the heap
+}
+
+// touch method counts a use of the key
+func (e *lfuEvictor) touch(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.clock++
+	if item, ok := e.keys[key]; ok {
+		item.count++
+		item.last = e.clock
+		heap.Fix(&e.heap, item.index)
+		return
+	}
+	item := &lfuItem{key: key, count: 1, last: e.clock}
+	e.keys[key] = item
+	heap.Push(&e.heap, item)
+}
+
+// remove method stops tracking the key
+func (e *lfuEvictor) remove(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if item, ok := e.keys[key]; ok {
+		heap.Remove(&e.heap, item.index)
+		delete(e.keys, key)
+	}
+}
+
+// tracked method reports whether the key is tracked
+func (e *lfuEvictor) tracked(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.keys[key]
+	return ok
+}
+
+// victim method removes and returns the least frequently used key
+func (e *lfuEvictor) victim(except string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var skipped *lfuItem
+	defer func() {
+		if skipped != nil {
+			heap.Push(&e.heap, skipped)
+		}
+	}()
+	for e.heap.Len() > 0 {
+		item := heap.Pop(&e.heap).(*lfuItem)
+		if item.key == except {
+			skipped = item
+			continue
+		}
+		delete(e.keys, item.key)
+		return item.key, true
+	}
+	return "", false
+}
+
+// lfuHeap type orders items by their use, implementing heap.Interface
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].last < h[j].last
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
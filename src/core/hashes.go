@@ -0,0 +1,81 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrNoSuchField = errors.New("no such field")
+
+// Fields returns the fields of a hash entry
+func (e Entry) Fields() (map[string]string, error) {
+	if e.Type != TypeHash {
+		return nil, ErrWrongType
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(e.Value), &fields); err != nil {
+		return nil, fmt.Errorf("cannot decode hash value: %w", err)
+	}
+	return fields, nil
+}
+
+// Field returns the value of a field of a hash entry, or
+// ErrNoSuchField if the hash doesn't have the field
+func (e Entry) Field(name string) (string, error) {
+	fields, err := e.Fields()
+	if err != nil {
+		return "", err
+	}
+	value, ok := fields[name]
+	if !ok {
+		return "", ErrNoSuchField
+	}
+	return value, nil
+}
+
+// hash returns the entry holding the fields as a hash value, fields are
+// encoded in sorted order so that the same fields always give the same value
+func hash(fields map[string]string) (Entry, error) {
+	value, err := json.Marshal(fields)
+	if err != nil {
+		return Entry{}, fmt.Errorf("cannot encode hash value: %w", err)
+	}
+	return Entry{Value: string(value), Type: TypeHash}, nil
+}
+
+// HashSet returns an Update setting a field of a hash value, leaving its other
+// fields unchanged. Keys that don't exist are treated as empty hashes
+func HashSet(field, value string) Update {
+	return func(old Entry, exists bool) (Entry, error) {
+		fields := map[string]string{}
+		if exists {
+			var err error
+			if fields, err = old.Fields(); err != nil {
+				return Entry{}, err
+			}
+		}
+		fields[field] = value
+		return hash(fields)
+	}
+}
+
+// HashDelete returns an Update removing a field of a hash value, leaving its
+// other fields unchanged. It returns ErrNoSuchKey if the key doesn't exist,
+// or ErrNoSuchField if the hash doesn't have the field
+func HashDelete(field string) Update {
+	return func(old Entry, exists bool) (Entry, error) {
+		if !exists {
+			return Entry{}, ErrNoSuchKey
+		}
+		fields, err := old.Fields()
+		if err != nil {
+			return Entry{}, err
+		}
+		if _, ok := fields[field]; !ok {
+			return Entry{}, ErrNoSuchField
+		}
+		delete(fields, field)
+		return hash(fields)
+	}
+}
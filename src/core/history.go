@@ -0,0 +1,127 @@
+package core
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNoSuchVersion = errors.New("no such version")
+
+// DefaultHistoryRetention is the number of versions kept for each key
+// unless SetHistoryRetention is called
+const DefaultHistoryRetention = 10
+
+// DefaultTombstoneRetention is how long the history of a deleted key
+// is kept unless SetTombstoneRetention is called
+const DefaultTombstoneRetention = time.Hour
+
+// historyRetention is the number of versions kept for each key,
+// including the current version, history is disabled if it is 0
+var historyRetention atomic.Int64
+
+// tombstoneRetention is how long the history of a deleted key is kept
+var tombstoneRetention atomic.Int64
+
+func init() {
+	SetHistoryRetention(DefaultHistoryRetention)
+	SetTombstoneRetention(DefaultTombstoneRetention)
+}
+
+// Version type is a value previously held by a key
+type Version struct {
+	Entry
+	Deleted bool // Whether the key was deleted by this version
+}
+
+// SetHistoryRetention sets the number of versions kept for each key, including
+// the current version, or disables history if n is 0. Existing histories
+// are trimmed when their key is next written
+func SetHistoryRetention(n int) {
+	historyRetention.Store(int64(n))
+}
+
+// HistoryRetention returns the number of versions kept for each key
+func HistoryRetention() int {
+	return int(historyRetention.Load())
+}
+
+// SetTombstoneRetention sets how long the history of a deleted key is kept after
+// its deletion, so that churning keys doesn't grow the history without bound.
+// Expired histories are dropped as other keys of their shard are written
+func SetTombstoneRetention(d time.Duration) {
+	tombstoneRetention.Store(int64(d))
+}
+
+// History returns the retained versions of the key, oldest first, including
+// deletions, or ErrNoSuchKey if the key has no history
+func (s *Store) History(key string) ([]Version, error) {
+	sh := s.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	versions, ok := sh.history[key]
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	return append([]Version(nil), versions...), nil
+}
+
+// GetVersion returns the version of the key written by the transaction log event
+// with the provided sequence, or ErrNoSuchVersion if it is no longer retained
+func (s *Store) GetVersion(key string, sequence uint64) (Version, error) {
+	sh := s.shard(key)
+	sh.RLock()
+	defer sh.RUnlock()
+	for _, v := range sh.history[key] {
+		if v.Sequence == sequence {
+			return v, nil
+		}
+	}
+	return Version{}, ErrNoSuchVersion
+}
+
+// record appends the version to the key's history, discarding the oldest
+// versions beyond the retention, the caller must hold the shard's write lock
+func (sh *shard) record(key string, v Version) {
+	sh.expire()
+	retention := int(historyRetention.Load())
+	if retention <= 0 {
+		delete(sh.history, key)
+		return
+	}
+	versions := sh.history[key]
+	if len(versions) >= retention {
+		// The oldest versions are dropped in place, as History returns copies
+		n := copy(versions, versions[len(versions)-retention+1:])
+		versions = versions[:n]
+	}
+	sh.history[key] = append(versions, v)
+	if v.Deleted {
+		sh.tombstones = append(sh.tombstones, tombstone{key: key, version: v})
+	}
+}
+
+// forget drops the history of a key that has just been removed, along with
+// the tombstone recorded for its removal, the caller must hold the shard's write lock
+func (sh *shard) forget(key string) {
+	delete(sh.history, key)
+	if n := len(sh.tombstones); n > 0 && sh.tombstones[n-1].key == key {
+		sh.tombstones[n-1] = tombstone{}
+		sh.tombstones = sh.tombstones[:n-1]
+	}
+}
+
+// expire drops the history of keys deleted longer ago than the tombstone
+// retention, unless they have been written since, the caller must hold the
+// shard's write lock. Deletions without a time are expired immediately
+func (sh *shard) expire() {
+	cutoff := time.Now().Add(-time.Duration(tombstoneRetention.Load()))
+	for len(sh.tombstones) > 0 && !sh.tombstones[0].version.Modified.After(cutoff) {
+		t := sh.tombstones[0]
+		sh.tombstones[0] = tombstone{}
+		sh.tombstones = sh.tombstones[1:]
+		if versions := sh.history[t.key]; len(versions) > 0 && versions[len(versions)-1] == t.version {
+			delete(sh.history, t.key)
+		}
+	}
+}
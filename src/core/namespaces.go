@@ -0,0 +1,145 @@
+package core
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// DefaultNamespace is the namespace used by requests and
+// events that don't specify one
+const DefaultNamespace = "default"
+
+var ErrNoSuchNamespace = errors.New("no such namespace")
+var ErrNamespaceExists = errors.New("namespace already exists")
+
+// NamespaceOptions type contains the configuration of a namespace
+type NamespaceOptions struct {
+	Token string // Credential required to access the namespace, empty for none
+	Quota Quota  // Limits applied to the namespace's keyspace
+}
+
+// namespace type pairs an isolated store with its configuration
+type namespace struct {
+	store *Store
+	opts  NamespaceOptions
+}
+
+// namespaces is a concurrent-safe registry of every namespace
+var namespaces = struct {
+	sync.RWMutex
+	m map[string]*namespace
+}{
+	m: map[string]*namespace{DefaultNamespace: {store: store}},
+}
+
+// CreateNamespace creates a new namespace with its own keyspace, or
+// returns ErrNamespaceExists if the name is already in use
+func CreateNamespace(name string, opts NamespaceOptions) (*Store, error) {
+	namespaces.Lock()
+	defer namespaces.Unlock()
+	if _, ok := namespaces.m[name]; ok {
+		return nil, ErrNamespaceExists
+	}
+	engine, err := backend.Engine(name)
+	if err != nil {
+		return nil, err
+	}
+	s, err := openStore(name, engine, opts.Quota)
+	if err != nil {
+		return nil, err
+	}
+	ns := &namespace{store: s, opts: opts}
+	namespaces.m[name] = ns
+	return ns.store, nil
+}
+
+// ConfigureNamespace replaces the configuration of an existing namespace, such
+// as the default namespace. It must be called before the store is used
+func ConfigureNamespace(name string, opts NamespaceOptions) error {
+	namespaces.Lock()
+	defer namespaces.Unlock()
+	ns, ok := namespaces.m[name]
+	if !ok {
+		return ErrNoSuchNamespace
+	}
+	s, err := openStore(name, ns.store.engine, opts.Quota)
+	if err != nil {
+		return err
+	}
+	ns.store, ns.opts = s, opts
+	if name == DefaultNamespace {
+		store = s
+	}
+	return nil
+}
+
+// Namespace returns the store of the provided namespace
+// or ErrNoSuchNamespace if it has not been created
+func Namespace(name string) (*Store, error) {
+	namespaces.RLock()
+	defer namespaces.RUnlock()
+	ns, ok := namespaces.m[name]
+	if !ok {
+		return nil, ErrNoSuchNamespace
+	}
+	return ns.store, nil
+}
+
+// Namespaces returns the names of every namespace
+func Namespaces() []string {
+	namespaces.RLock()
+	defer namespaces.RUnlock()
+	names := make([]string, 0, len(namespaces.m))
+	for name := range namespaces.m {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Snapshot returns a copy of the entries of every namespace as of a single
+// point in time. Writers are only blocked while the entries are copied. If
+// commit is not nil it is called at that point and its sequence is returned
+func Snapshot(commit Commit) (map[string]map[string]Entry, uint64, error) {
+	namespaces.RLock()
+	defer namespaces.RUnlock()
+	// Stores are locked in name order so concurrent snapshots can't deadlock
+	names := make([]string, 0, len(namespaces.m))
+	for name := range namespaces.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	unlock := make([]func(), len(names))
+	for i, name := range names {
+		unlock[i] = namespaces.m[name].store.rlockAll()
+	}
+	var sequence uint64
+	if commit != nil {
+		sequence = commit()
+	}
+	snapshot := make(map[string]map[string]Entry, len(names))
+	var err error
+	for i, name := range names {
+		if err == nil {
+			snapshot[name], err = namespaces.m[name].store.entries("")
+		}
+		unlock[i]()
+	}
+	return snapshot, sequence, err
+}
+
+// Authorize reports whether the provided token grants access to the
+// namespace, namespaces without a configured token are open to everyone
+func Authorize(name string, token string) bool {
+	namespaces.RLock()
+	defer namespaces.RUnlock()
+	ns, ok := namespaces.m[name]
+	if !ok {
+		return false
+	}
+	if ns.opts.Token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(ns.opts.Token), []byte(token)) == 1
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// shardCount is the number of independently locked segments of each store,
+// writes only block reads and writes of keys in the same segment
+const shardCount = 32
+
+// shardSeed seeds the hash partitioning keys between segments
+var shardSeed = maphash.MakeSeed()
+
+// shardIndex returns the segment holding the key
+func shardIndex(key string) int {
+	return int(maphash.String(shardSeed, key) % shardCount)
+}
+
+// shard type is a segment of a store, its lock guards the writes
+// and history of the keys hashed to it
+type shard struct {
+	sync.RWMutex
+	history    map[string][]Version // Previous versions of each key, oldest first
+	tombstones []tombstone          // Deletions whose history is yet to expire, oldest first
+}
+
+// tombstone type is the deletion of a key, whose history
+// is dropped once the tombstone retention has passed
+type tombstone struct {
+	key     string
+	version Version
+}
+
+// newShards creates the segments of a store
+func newShards() []shard {
+	shards := make([]shard, shardCount)
+	for i := range shards {
+		shards[i].history = make(map[string][]Version)
+	}
+	return shards
+}
+
+// shard returns the segment holding the key
+func (s *Store) shard(key string) *shard {
+	return &s.shards[shardIndex(key)]
+}
+
+// rlockAll read locks every segment in order, so that the store can be
+// read as of a single point in time, and returns a function unlocking them
+func (s *Store) rlockAll() func() {
+	for i := range s.shards {
+		s.shards[i].RLock()
+	}
+	return func() {
+		for i := range s.shards {
+			s.shards[i].RUnlock()
+		}
+	}
+}
+
+// adjust changes the number of keys and bytes held by the store
+func (s *Store) adjust(keys, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys += keys
+	s.size += size
+}
+
+// reserve changes the number of keys and bytes held by the store, or returns
+// ErrQuotaExceeded without changing them if doing so would exceed the quota
+func (s *Store) reserve(keys, size int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quota.MaxKeys > 0 && s.keys+keys > s.quota.MaxKeys {
+		return ErrQuotaExceeded
+	}
+	if s.quota.MaxBytes > 0 && s.size+size > s.quota.MaxBytes {
+		return ErrQuotaExceeded
+	}
+	s.keys += keys
+	s.size += size
+	return nil
+}
@@ -0,0 +1,273 @@
+package engines
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"rohitsingh/vile/core"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltNamespaces = []byte("namespaces") // Bucket holding a bucket of entries for each namespace
+	boltMeta       = []byte("meta")       // Bucket holding the checkpoint and the stats bucket
+	boltStats      = []byte("stats")      // Bucket of the key count and size of each namespace
+	boltCheckpoint = []byte("checkpoint") // Key of the last persisted sequence in the meta bucket
+)
+
+// boltRecord type is the encoding of an entry in a namespace's bucket
+type boltRecord struct {
+	Value    string         `json:"value"`              // Value, encrypted if KeyID is set
+	Type     core.ValueType `json:"type,omitempty"`     // Type of the value
+	KeyID    string         `json:"kid,omitempty"`      // ID of the key the value is encrypted with
+	Size     int            `json:"size"`               // Length of the unencrypted value
+	Modified time.Time      `json:"modified,omitempty"` // Time the value was last written
+	Sequence uint64         `json:"seq,omitempty"`      // Sequence of the event that wrote the value
+}
+
+// BoltBackend type stores the entries of every namespace in an embedded
+// B+tree file, so data isn't bounded by memory and is available on startup
+// without replaying the transaction log
+type BoltBackend struct {
+	db        *bolt.DB // Database file
+	cacheSize int      // Number of entries cached in memory per namespace, 0 for none
+}
+
+// NewBoltBackend opens the database file at path, creating it if it doesn't exist.
+// If cacheSize is positive up to that many of the most recently used entries of
+// each namespace are also kept in memory
+func NewBoltBackend(path string, cacheSize int) (*BoltBackend, error) {
+	// Fail rather than wait forever if another server holds the file
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open bolt database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltNamespaces); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMeta)
+		if err != nil {
+			return err
+		}
+		_, err = meta.CreateBucketIfNotExists(boltStats)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create bolt buckets: %w", err)
+	}
+	return &BoltBackend{db: db, cacheSize: cacheSize}, nil
+}
+
+// Engine method returns the engine of the namespace's bucket, creating the bucket if needed
+func (b *BoltBackend) Engine(namespace string) (core.Engine, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(boltNamespaces).CreateBucketIfNotExists([]byte(namespace))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create namespace bucket: %w", err)
+	}
+	var e core.Engine = &boltEngine{db: b.db, namespace: []byte(namespace)}
+	if b.cacheSize > 0 {
+		e = core.NewCachedEngine(e, b.cacheSize)
+	}
+	return e, nil
+}
+
+// Checkpoint method returns the last transaction log sequence written to the database
+func (b *BoltBackend) Checkpoint() (uint64, error) {
+	var sequence uint64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		sequence = readUint(tx.Bucket(boltMeta).Get(boltCheckpoint))
+		return nil
+	})
+	return sequence, err
+}
+
+// Close method closes the database file
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
+
+// boltEngine type is the engine of a single namespace's bucket
+type boltEngine struct {
+	db        *bolt.DB
+	namespace []byte
+}
+
+// Get method returns the entry of the key
+func (e *boltEngine) Get(key string) (core.Entry, bool, error) {
+	var record boltRecord
+	var ok bool
+	err := e.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, ok, err = e.read(tx, key)
+		return err
+	})
+	if err != nil || !ok {
+		return core.Entry{}, false, err
+	}
+	entry, err := record.entry()
+	return entry, err == nil, err
+}
+
+// Put method writes the entry of the key, advancing the checkpoint
+// in the same transaction so that it never gets ahead of the data
+func (e *boltEngine) Put(key string, entry core.Entry, checkpoint uint64) error {
+	value, keyID, err := core.Encrypt(entry.Value)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(boltRecord{
+		Value:    value,
+		Type:     entry.Type,
+		KeyID:    keyID,
+		Size:     len(entry.Value),
+		Modified: entry.Modified,
+		Sequence: entry.Sequence,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot encode key: %w", err)
+	}
+	err = e.db.Update(func(tx *bolt.Tx) error {
+		old, exists, err := e.read(tx, key)
+		if err != nil {
+			return err
+		}
+		keys, size := 1, len(key)+len(entry.Value)
+		if exists {
+			keys, size = 0, len(entry.Value)-old.Size
+		}
+		if err := e.bucket(tx).Put([]byte(key), data); err != nil {
+			return err
+		}
+		return e.commit(tx, keys, size, checkpoint)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot write key: %w", err)
+	}
+	return nil
+}
+
+// Delete method removes the key, advancing the checkpoint in the same transaction
+func (e *boltEngine) Delete(key string, checkpoint uint64) error {
+	err := e.db.Update(func(tx *bolt.Tx) error {
+		old, exists, err := e.read(tx, key)
+		if err != nil {
+			return err
+		}
+		keys, size := 0, 0
+		if exists {
+			keys, size = -1, -len(key)-old.Size
+			if err := e.bucket(tx).Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return e.commit(tx, keys, size, checkpoint)
+	})
+	if err != nil {
+		return fmt.Errorf("cannot delete key: %w", err)
+	}
+	return nil
+}
+
+// Range method calls fn for each key with the prefix in key order. The
+// entries are read in a single transaction, so they are a consistent view
+func (e *boltEngine) Range(prefix string, fn func(key string, entry core.Entry) bool) error {
+	return e.db.View(func(tx *bolt.Tx) error {
+		c := e.bucket(tx).Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			var record boltRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("cannot decode key: %w", err)
+			}
+			entry, err := record.entry()
+			if err != nil {
+				return err
+			}
+			if !fn(string(k), entry) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Stats method returns the number of keys and bytes held by the namespace,
+// which are kept up to date by each write so they don't require a scan
+func (e *boltEngine) Stats() (int, int, error) {
+	var keys, size int
+	err := e.db.View(func(tx *bolt.Tx) error {
+		keys, size = readStats(tx.Bucket(boltMeta).Bucket(boltStats).Get(e.namespace))
+		return nil
+	})
+	return keys, size, err
+}
+
+// bucket returns the bucket of the namespace's entries
+func (e *boltEngine) bucket(tx *bolt.Tx) *bolt.Bucket {
+	return tx.Bucket(boltNamespaces).Bucket(e.namespace)
+}
+
+// read returns the record of the key and whether it exists
+func (e *boltEngine) read(tx *bolt.Tx, key string) (boltRecord, bool, error) {
+	var record boltRecord
+	data := e.bucket(tx).Get([]byte(key))
+	if data == nil {
+		return record, false, nil
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, false, fmt.Errorf("cannot decode key: %w", err)
+	}
+	return record, true, nil
+}
+
+// commit adjusts the namespace's stats by the change in keys and bytes,
+// and advances the checkpoint if it is later
+func (e *boltEngine) commit(tx *bolt.Tx, keys, size int, checkpoint uint64) error {
+	meta := tx.Bucket(boltMeta)
+	stats := meta.Bucket(boltStats)
+	k, s := readStats(stats.Get(e.namespace))
+	if err := stats.Put(e.namespace, writeStats(k+keys, s+size)); err != nil {
+		return err
+	}
+	if checkpoint > readUint(meta.Get(boltCheckpoint)) {
+		return meta.Put(boltCheckpoint, binary.BigEndian.AppendUint64(nil, checkpoint))
+	}
+	return nil
+}
+
+// entry returns the decrypted entry of the record
+func (r boltRecord) entry() (core.Entry, error) {
+	value, err := core.Decrypt(r.Value, r.KeyID)
+	return core.Entry{Value: value, Type: r.Type, Modified: r.Modified, Sequence: r.Sequence}, err
+}
+
+// readUint decodes a big-endian integer, returning 0 if it isn't set
+func readUint(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// readStats decodes the key count and size of a namespace
+func readStats(b []byte) (int, int) {
+	if len(b) != 16 {
+		return 0, 0
+	}
+	return int(binary.BigEndian.Uint64(b[:8])), int(binary.BigEndian.Uint64(b[8:]))
+}
+
+// writeStats encodes the key count and size of a namespace
+func writeStats(keys, size int) []byte {
+	b := binary.BigEndian.AppendUint64(nil, uint64(keys))
+	return binary.BigEndian.AppendUint64(b, uint64(size))
+}
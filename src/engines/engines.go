@@ -0,0 +1,65 @@
+// Package engines provides the storage backends that core can hold
+// its namespaces in, other than the default in-memory backend
+package engines
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"rohitsingh/vile/core"
+	"rohitsingh/vile/transaction_logs"
+)
+
+// FromEnv creates the storage backend named by VILE_ENGINE, either "memory", "bolt"
+// or "postgres", returning nil for the default in-memory backend. The bolt backend
+// stores its file at VILE_BOLT_PATH. The Postgres backend is configured by the same
+// VILE_PG_* variables as the transaction log, except that its table is named by
+// VILE_PG_KV_TABLE. VILE_ENGINE_CACHE_SIZE sets
+// the number of entries of each namespace kept in memory by persistent backends
+func FromEnv() (core.Backend, error) {
+	cacheSize := 0
+	if v := os.Getenv("VILE_ENGINE_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("VILE_ENGINE_CACHE_SIZE must be a non-negative integer")
+		}
+		cacheSize = n
+	}
+	switch engine := os.Getenv("VILE_ENGINE"); engine {
+	case "", "memory":
+		return nil, nil
+	case "bolt":
+		path := os.Getenv("VILE_BOLT_PATH")
+		if path == "" {
+			path = "vile.bolt"
+		}
+		return NewBoltBackend(path, cacheSize)
+	case "postgres":
+		c, err := transaction_logs.PostgresConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		c.Table = "kv"
+		if v := os.Getenv("VILE_PG_KV_TABLE"); v != "" {
+			c.Table = v
+		}
+		return NewPostgresBackend(c, cacheSize)
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", engine)
+	}
+}
+
+// Configure holds every namespace in the backend named by VILE_ENGINE, returning
+// a function that closes the backend. It must be called before the store is used
+func Configure() (func() error, error) {
+	b, err := FromEnv()
+	if err != nil || b == nil {
+		return func() error { return nil }, err
+	}
+	if err := core.SetBackend(b); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b.Close, nil
+}
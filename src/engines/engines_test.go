@@ -0,0 +1,92 @@
+package engines
+
+import (
+	"path/filepath"
+	"testing"
+
+	"rohitsingh/vile/core"
+)
+
+func TestEscapeLike(t *testing.T) {
+	testCases := map[string]string{
+		"users/":    "users/",
+		"100%":      `100\%`,
+		"snake_key": `snake\_key`,
+		`back\`:     `back\\`,
+	}
+	for prefix, exp := range testCases {
+		if got := escapeLike(prefix); got != exp {
+			t.Errorf("expected %q to be escaped as %q, instead got %q", prefix, exp, got)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("VILE_ENGINE", "memory")
+	if b, err := FromEnv(); b != nil || err != nil {
+		t.Errorf("expected the default backend, instead got %v (%v)", b, err)
+	}
+	t.Setenv("VILE_ENGINE", "unknown")
+	if _, err := FromEnv(); err == nil {
+		t.Error("expected an error for an unknown engine")
+	}
+}
+
+func TestBoltBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vile.bolt")
+	b, err := NewBoltBackend(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := b.Engine("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"users/b", "users/a", "orders/a"} {
+		if err := e.Put(key, core.Entry{Value: "value", Sequence: uint64(i + 1)}, uint64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Put("users/a", core.Entry{Value: "v", Type: core.TypeList, Sequence: 4}, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Delete("orders/a", 5); err != nil {
+		t.Fatal(err)
+	}
+	// Earlier checkpoints don't move the checkpoint back
+	if err := e.Put("users/c", core.Entry{Value: "c", Sequence: 7}, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Delete("users/c", 0); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	// Entries, stats and the checkpoint should persist across reopening
+	if b, err = NewBoltBackend(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if e, err = b.Engine("default"); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := b.Checkpoint(); seq != 5 || err != nil {
+		t.Errorf("expected checkpoint 5, instead got %d (%v)", seq, err)
+	}
+	if keys, size, _ := e.Stats(); keys != 2 || size != len("users/a")+1+len("users/b")+5 {
+		t.Errorf("unexpected stats %d keys, %d bytes", keys, size)
+	}
+	if entry, ok, err := e.Get("users/a"); !ok || err != nil || entry.Value != "v" || entry.Type != core.TypeList || entry.Sequence != 4 {
+		t.Errorf("unexpected entry %+v (%v, %v)", entry, ok, err)
+	}
+	if _, ok, _ := e.Get("orders/a"); ok {
+		t.Error("expected orders/a to be deleted")
+	}
+	var keys []string
+	e.Range("users/", func(key string, entry core.Entry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 2 || keys[0] != "users/a" || keys[1] != "users/b" {
+		t.Errorf("expected users/a and users/b in order, instead got %v", keys)
+	}
+}
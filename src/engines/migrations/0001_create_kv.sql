@@ -0,0 +1,17 @@
+-- Keys use the C collation so that prefix scans can use the primary key
+CREATE TABLE IF NOT EXISTS {{table}} (
+	namespace  TEXT NOT NULL,
+	key        TEXT COLLATE "C" NOT NULL,
+	value      TEXT NOT NULL,
+	key_id     TEXT NOT NULL DEFAULT '',
+	value_size INTEGER NOT NULL,
+	modified   TIMESTAMPTZ,
+	sequence   BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (namespace, key)
+);
+
+-- The last transaction log sequence applied to each kv table
+CREATE TABLE IF NOT EXISTS {{schema}}.vile_checkpoints (
+	table_name TEXT PRIMARY KEY,
+	sequence   BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,2 @@
+-- Record the type of each value, so that list and set values keep their type
+ALTER TABLE {{table}} ADD COLUMN IF NOT EXISTS value_type TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,193 @@
+package engines
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"rohitsingh/vile/core"
+	"rohitsingh/vile/transaction_logs"
+
+	"github.com/lib/pq"
+)
+
+// postgresMigrationFiles are the ordered schema migrations of the kv table
+//
+//go:embed migrations/*.sql
+var postgresMigrationFiles embed.FS
+
+// PostgresBackend type stores the entries of every namespace in a single table,
+// so that data isn't bounded by memory and doesn't need to be replayed on startup
+type PostgresBackend struct {
+	db          *sql.DB // Database access interface
+	name        string  // Unquoted name of the kv table
+	table       string  // Quoted name of the kv table
+	checkpoints string  // Quoted name of the checkpoints table
+	cacheSize   int     // Number of entries cached in memory per namespace, 0 for none
+}
+
+// NewPostgresBackend connects to the configured database, creating or upgrading the
+// kv table named by c.Table. If cacheSize is positive up to that many of the most
+// recently used entries of each namespace are also kept in memory
+func NewPostgresBackend(c transaction_logs.PostgresDBConfig, cacheSize int) (*PostgresBackend, error) {
+	db, err := transaction_logs.OpenPostgres(c)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := fs.Sub(postgresMigrationFiles, "migrations")
+	if err == nil {
+		err = transaction_logs.MigratePostgres(db, c.Schema, c.Table, migrations)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error while migrating kv schema: %w", err)
+	}
+	b := &PostgresBackend{
+		db:          db,
+		name:        c.Table,
+		table:       pq.QuoteIdentifier(c.Schema) + "." + pq.QuoteIdentifier(c.Table),
+		checkpoints: pq.QuoteIdentifier(c.Schema) + ".vile_checkpoints",
+		cacheSize:   cacheSize,
+	}
+	_, err = db.Exec("INSERT INTO "+b.checkpoints+" (table_name) VALUES ($1) ON CONFLICT DO NOTHING", b.name)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error while creating checkpoint: %w", err)
+	}
+	return b, nil
+}
+
+// Engine method returns the engine of the namespace's rows
+func (b *PostgresBackend) Engine(namespace string) (core.Engine, error) {
+	var e core.Engine = &postgresEngine{b: b, namespace: namespace}
+	if b.cacheSize > 0 {
+		e = core.NewCachedEngine(e, b.cacheSize)
+	}
+	return e, nil
+}
+
+// Checkpoint method returns the last transaction log sequence written to the table
+func (b *PostgresBackend) Checkpoint() (uint64, error) {
+	var sequence uint64
+	err := b.db.QueryRow("SELECT sequence FROM "+b.checkpoints+" WHERE table_name = $1", b.name).Scan(&sequence)
+	return sequence, err
+}
+
+// Close method closes the connections to the database
+func (b *PostgresBackend) Close() error {
+	return b.db.Close()
+}
+
+// postgresEngine type is the engine of a single namespace's rows in the kv table
+type postgresEngine struct {
+	b         *PostgresBackend
+	namespace string
+}
+
+// Get method returns the entry of the key
+func (e *postgresEngine) Get(key string) (core.Entry, bool, error) {
+	var value, keyID string
+	var modified sql.NullTime
+	var entry core.Entry
+	err := e.b.db.QueryRow(
+		"SELECT value, value_type, key_id, modified, sequence FROM "+e.b.table+" WHERE namespace = $1 AND key = $2",
+		e.namespace, key,
+	).Scan(&value, &entry.Type, &keyID, &modified, &entry.Sequence)
+	if err == sql.ErrNoRows {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, fmt.Errorf("cannot read key: %w", err)
+	}
+	entry.Modified = modified.Time
+	entry.Value, err = core.Decrypt(value, keyID)
+	return entry, err == nil, err
+}
+
+// Put method upserts the entry of the key, advancing the checkpoint
+// in the same statement so that it never gets ahead of the data
+func (e *postgresEngine) Put(key string, entry core.Entry, checkpoint uint64) error {
+	value, keyID, err := core.Encrypt(entry.Value)
+	if err != nil {
+		return err
+	}
+	var modified sql.NullTime
+	if !entry.Modified.IsZero() {
+		modified = sql.NullTime{Time: entry.Modified, Valid: true}
+	}
+	_, err = e.b.db.Exec(`WITH upsert AS (
+			INSERT INTO `+e.b.table+` (namespace, key, value, value_type, key_id, value_size, modified, sequence)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (namespace, key) DO UPDATE SET value = EXCLUDED.value, value_type = EXCLUDED.value_type,
+				key_id = EXCLUDED.key_id, value_size = EXCLUDED.value_size, modified = EXCLUDED.modified,
+				sequence = EXCLUDED.sequence
+		)
+		UPDATE `+e.b.checkpoints+` SET sequence = GREATEST(sequence, $9) WHERE table_name = $10`,
+		e.namespace, key, value, entry.Type, keyID, len(entry.Value), modified, entry.Sequence, checkpoint, e.b.name,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot write key: %w", err)
+	}
+	return nil
+}
+
+// Delete method removes the key, advancing the checkpoint in the same statement
+func (e *postgresEngine) Delete(key string, checkpoint uint64) error {
+	_, err := e.b.db.Exec(`WITH removed AS (
+			DELETE FROM `+e.b.table+` WHERE namespace = $1 AND key = $2
+		)
+		UPDATE `+e.b.checkpoints+` SET sequence = GREATEST(sequence, $3) WHERE table_name = $4`,
+		e.namespace, key, checkpoint, e.b.name,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot delete key: %w", err)
+	}
+	return nil
+}
+
+// Range method calls fn for each key with the prefix in key order,
+// the scan uses the primary key as keys are compared bytewise
+func (e *postgresEngine) Range(prefix string, fn func(key string, entry core.Entry) bool) error {
+	rows, err := e.b.db.Query(
+		"SELECT key, value, value_type, key_id, modified, sequence FROM "+e.b.table+
+			" WHERE namespace = $1 AND key LIKE $2 ORDER BY key",
+		e.namespace, escapeLike(prefix)+"%",
+	)
+	if err != nil {
+		return fmt.Errorf("cannot scan keys: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value, keyID string
+		var modified sql.NullTime
+		var entry core.Entry
+		if err := rows.Scan(&key, &value, &entry.Type, &keyID, &modified, &entry.Sequence); err != nil {
+			return fmt.Errorf("cannot scan keys: %w", err)
+		}
+		entry.Modified = modified.Time
+		if entry.Value, err = core.Decrypt(value, keyID); err != nil {
+			return err
+		}
+		if !fn(key, entry) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+// Stats method returns the number of keys and bytes held by the namespace
+func (e *postgresEngine) Stats() (int, int, error) {
+	var keys, size int
+	err := e.b.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(octet_length(key) + value_size), 0) FROM "+e.b.table+" WHERE namespace = $1",
+		e.namespace,
+	).Scan(&keys, &size)
+	return keys, size, err
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -1,11 +1,21 @@
 package main
 
 import (
-	"log"
+	"log/slog"
+	"os"
 	"rohitsingh/vile/server"
 )
 
 func main() {
-	log.Print("Starting vile...")
+	server.ConfigureLogging()
+	// The recover subcommand restores the store to an earlier point
+	if len(os.Args) > 1 && os.Args[1] == "recover" {
+		if err := recoverCommand(os.Args[2:]); err != nil {
+			slog.Error("Could not recover store", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	slog.Info("Starting vile...")
 	server.Run()
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"rohitsingh/vile/engines"
+	"rohitsingh/vile/transaction_logs"
+)
+
+// recoverCommand restores the store to its state as of a sequence or time by
+// appending the necessary events to the transaction log located by VILE_TX_LOG.
+// It should be run while the server is stopped
+func recoverCommand(args []string) error {
+	flags := flag.NewFlagSet("recover", flag.ContinueOnError)
+	sequence := flags.Uint64("sequence", 0, "last transaction log sequence to recover")
+	at := flags.String("time", "", "latest event time to recover (RFC 3339)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	point := transaction_logs.RecoveryPoint{Sequence: *sequence}
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return fmt.Errorf("invalid recovery time: %w", err)
+		}
+		point.Time = t
+	}
+	closeEngine, err := engines.Configure()
+	if err != nil {
+		return err
+	}
+	defer closeEngine()
+	tl, err := transaction_logs.InitializeTransactionLog(os.Getenv("VILE_TX_LOG"))
+	if err != nil {
+		return err
+	}
+	defer tl.Close()
+	result, err := transaction_logs.Recover(tl, point)
+	if err != nil {
+		return err
+	}
+	tl.Wait()
+	fmt.Printf("Recovered store to sequence %d (%d keys restored, %d keys deleted)\n",
+		result.Sequence, result.Puts, result.Deletes)
+	return nil
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// adminToken is the credential required to use the admin API, which
+// is disabled if it is empty. It is loaded from VILE_ADMIN_TOKEN
+var adminToken string
+
+// adminMiddleware rejects requests to the admin API that
+// don't provide the admin token as a bearer token
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			replyError(w, r, http.StatusForbidden, "Admin API is disabled")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			replyError(w, r, http.StatusUnauthorized, "Not authorized for admin API")
+			return
+		}
+		auditFrom(r).identity = "admin"
+		next.ServeHTTP(w, r)
+	})
+}
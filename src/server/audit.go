@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"rohitsingh/vile/audit"
+
+	"github.com/gorilla/mux"
+)
+
+// auditLog records every mutating request, it is disabled if nil
+var auditLog *audit.Log
+
+// auditInfo type collects the details of a request that are
+// only known by its handler, such as the resulting sequence
+type auditInfo struct {
+	namespace string // Namespace the request was made to
+	identity  string // Who made the request
+	sequence  uint64 // Sequence of the resulting transaction log event
+}
+
+// auditFrom returns the auditInfo of the request, or a
+// throwaway value if the request is not being audited
+func auditFrom(r *http.Request) *auditInfo {
+	if info, ok := r.Context().Value(auditKey).(*auditInfo); ok {
+		return info
+	}
+	return &auditInfo{}
+}
+
+// auditMiddleware appends a record to the audit log for every mutating request,
+// including those that are rejected, once the request has been handled. The
+// operation is recorded by its method and route, e.g. "PUT /v1/key/{key}"
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auditLog == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info := &auditInfo{identity: "anonymous"}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditKey, info)))
+		sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			sourceIP = r.RemoteAddr
+		}
+		_, err = auditLog.Append(audit.Record{
+			Time:      time.Now(),
+			Identity:  info.identity,
+			SourceIP:  sourceIP,
+			RequestID: requestID(r.Context()),
+			Operation: r.Method + " " + routeTemplate(r),
+			Namespace: info.namespace,
+			Key:       mux.Vars(r)["key"],
+			Field:     mux.Vars(r)["field"],
+			Status:    rec.status,
+			Sequence:  info.sequence,
+		})
+		if err != nil {
+			logFrom(r).Error("Could not append to audit log", "error", err)
+		}
+	})
+}
+
+// auditHandler returns the audit records matching the query parameters
+// identity, operation, namespace, key, field, since, until (RFC 3339) and limit
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if auditLog == nil {
+		replyError(w, r, http.StatusNotFound, "Audit log is disabled")
+		return
+	}
+	q := r.URL.Query()
+	filter := audit.Filter{
+		Identity:  q.Get("identity"),
+		Operation: q.Get("operation"),
+		Namespace: q.Get("namespace"),
+		Key:       q.Get("key"),
+		Field:     q.Get("field"),
+	}
+	var err error
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := q.Get(param); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				replyError(w, r, http.StatusBadRequest, "Invalid time in audit query", "param", param)
+				return
+			}
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			replyError(w, r, http.StatusBadRequest, "Invalid limit in audit query")
+			return
+		}
+	}
+	records, err := auditLog.Query(filter)
+	if errors.Is(err, audit.ErrTampered) {
+		replyError(w, r, http.StatusConflict, "Audit log failed verification", "error", err)
+		return
+	}
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Could not query audit log", "error", err)
+		return
+	}
+	replyJSON(w, r, http.StatusOK, records)
+}
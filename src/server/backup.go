@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"rohitsingh/vile/transaction_logs"
+)
+
+// backupHandler streams a consistent snapshot of every namespace
+// in the portable backup format
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("vile-backup-%s.jsonl", time.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	header, err := transaction_logs.WriteBackup(w, transact)
+	if err != nil {
+		// The status has already been sent, so the backup is left truncated
+		logFrom(r).Error("Could not write backup", "error", err)
+		return
+	}
+	logFrom(r).Info("Wrote backup", "sequence", header.Sequence)
+}
+
+// restoreHandler replaces the contents of every namespace
+// with the backup provided in the request body
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	result, err := transaction_logs.Restore(transact, r.Body)
+	if errors.Is(err, transaction_logs.ErrInvalidBackup) {
+		replyError(w, r, http.StatusBadRequest, "Invalid backup", "error", err)
+		return
+	}
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Could not restore backup", "error", err)
+		return
+	}
+	logFrom(r).Warn("Restored backup",
+		"sequence", result.Sequence, "puts", result.Puts, "deletes", result.Deletes)
+	replyJSON(w, r, http.StatusOK, result)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"rohitsingh/vile/core"
+	"rohitsingh/vile/transaction_logs"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// operations maps the operation in the path of a request to the
+// event recording it in the transaction log
+var operations = map[string]transaction_logs.EventType{
+	"append": transaction_logs.EventAppend,
+	"lpush":  transaction_logs.EventPushFront,
+	"rpush":  transaction_logs.EventPushBack,
+	"lpop":   transaction_logs.EventPopFront,
+	"rpop":   transaction_logs.EventPopBack,
+	"sadd":   transaction_logs.EventSetAdd,
+	"srem":   transaction_logs.EventSetRemove,
+}
+
+// operationHandler atomically applies the operation in the path to the value
+// of the key, using the request body as its operand, and returns the new value.
+// Pops return the removed element instead. The operation itself is logged, so
+// that it is replayed against the value the key held when it was applied
+func operationHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	eventType := operations[mux.Vars(r)["operation"]]
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
+	pop := eventType == transaction_logs.EventPopFront || eventType == transaction_logs.EventPopBack
+	var operand []byte
+	if !pop {
+		var err error
+		operand, err = io.ReadAll(r.Body)
+		defer r.Body.Close()
+		if err != nil {
+			replyError(w, r, http.StatusInternalServerError, "Could not read request body", "error", err)
+			return
+		}
+	}
+	modified := time.Now()
+	event := transaction_logs.Event{
+		EventType:    eventType,
+		Namespace:    ns,
+		Key:          key,
+		Value:        string(operand),
+		Timestamp:    modified,
+		RequestID:    requestID(r.Context()),
+		TraceContext: trace.SpanContextFromContext(r.Context()),
+	}
+	update, _ := event.Operation()
+	var popped string
+	if pop {
+		update = core.Pop(eventType == transaction_logs.EventPopFront, &popped)
+	}
+	commit := func(string) uint64 {
+		store.NoteOperation()
+		seq := transact.WriteEvent(event)
+		auditFrom(r).sequence = seq
+		return seq
+	}
+	var entry core.Entry
+	err := traceStore(r.Context(), "core.Update", ns, func() (err error) {
+		entry, err = store.UpdateAt(key, update, modified, commit)
+		return err
+	})
+	switch {
+	case errors.Is(err, core.ErrWrongType):
+		replyError(w, r, http.StatusConflict, "Value is of the wrong type", "key", key, "error", err)
+	case errors.Is(err, core.ErrNoSuchKey), errors.Is(err, core.ErrEmptyList):
+		replyError(w, r, http.StatusNotFound, "Could not pop from list", "key", key, "error", err)
+	case errors.Is(err, core.ErrQuotaExceeded):
+		replyError(w, r, http.StatusInsufficientStorage, "Namespace quota exceeded", "namespace", ns)
+	case err != nil:
+		replyError(w, r, http.StatusInternalServerError, "Could not update value", "key", key, "error", err)
+	case pop:
+		replyTextContent(w, r, http.StatusOK, popped)
+	default:
+		replyEntry(w, r, http.StatusOK, entry)
+	}
+}
+
+// replyEntry sends the value of the entry, list and set values are sent as
+// JSON arrays, and the type of the value is sent in the X-Vile-Type header
+func replyEntry(w http.ResponseWriter, r *http.Request, status int, entry core.Entry) {
+	if entry.Type == core.TypeString {
+		replyTextContent(w, r, status, entry.Value)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Vile-Type", string(entry.Type))
+	w.WriteHeader(status)
+	w.Write([]byte(entry.Value + "\n"))
+}
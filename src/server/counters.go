@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rohitsingh/vile/core"
+	"rohitsingh/vile/transaction_logs"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// incrHandler atomically adds the by query parameter, 1 by default, to the
+// integer value of the key and returns the result. Requests to the decr
+// route subtract it instead. Keys that don't exist are treated as 0
+func incrHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
+	by := int64(1)
+	if v := r.URL.Query().Get("by"); v != "" {
+		var err error
+		if by, err = strconv.ParseInt(v, 10, 64); err != nil || by == math.MinInt64 {
+			replyError(w, r, http.StatusBadRequest, "Invalid increment", "by", v)
+			return
+		}
+	}
+	if strings.HasSuffix(r.URL.Path, "/decr") {
+		by = -by
+	}
+	// The resulting value is logged, so replaying the event doesn't depend on earlier events
+	modified := time.Now()
+	commit := func(value string) uint64 {
+		seq := transact.WriteEvent(transaction_logs.Event{
+			EventType:    transaction_logs.EventPut,
+			Namespace:    ns,
+			Key:          key,
+			Value:        value,
+			Timestamp:    modified,
+			RequestID:    requestID(r.Context()),
+			TraceContext: trace.SpanContextFromContext(r.Context()),
+		})
+		auditFrom(r).sequence = seq
+		return seq
+	}
+	var entry core.Entry
+	err := traceStore(r.Context(), "core.Increment", ns, func() (err error) {
+		entry, err = store.UpdateAt(key, core.Increment(by), modified, commit)
+		return err
+	})
+	switch {
+	case errors.Is(err, core.ErrNotInteger), errors.Is(err, core.ErrOverflow), errors.Is(err, core.ErrWrongType):
+		replyError(w, r, http.StatusConflict, "Could not increment value", "key", key, "error", err)
+	case errors.Is(err, core.ErrQuotaExceeded):
+		replyError(w, r, http.StatusInsufficientStorage, "Namespace quota exceeded", "namespace", ns)
+	case err != nil:
+		replyError(w, r, http.StatusInternalServerError, "Could not increment value", "key", key, "error", err)
+	default:
+		replyTextContent(w, r, http.StatusOK, entry.Value)
+	}
+}
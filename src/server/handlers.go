@@ -1,21 +1,33 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"time"
 
 	// server needs core access to write and read from store
 	// for incoming HTTP requests
 	"rohitsingh/vile/core"
 
+	// server needs audit access to record who changed what
+	"rohitsingh/vile/audit"
+
+	// server needs engines access to hold the store in the configured engine
+	"rohitsingh/vile/engines"
+
 	// server needs transaction_logs access to record
 	// HTTP request history in the transaction log
 	"rohitsingh/vile/transaction_logs"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var transact transaction_logs.TransactionLogger
@@ -24,35 +36,131 @@ func NewMux() http.Handler {
 	r := mux.NewRouter()
 	// Root path can be used as a liveness check
 	r.HandleFunc("/", rootHandler).Methods(http.MethodGet)
+	// Metrics are exposed for Prometheus to scrape
+	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	// Liveness and readiness probes
+	r.HandleFunc("/healthz", healthzHandler).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", readyzHandler).Methods(http.MethodGet)
+	// The admin API requires the admin token
+	a := r.PathPrefix("/v1/admin").Subrouter()
+	a.Use(replayMiddleware, auditMiddleware, adminMiddleware)
+	a.HandleFunc("/audit", auditHandler).Methods(http.MethodGet)
+	a.HandleFunc("/recover", recoverHandler).Methods(http.MethodPost)
+	a.HandleFunc("/backup", backupHandler).Methods(http.MethodGet)
+	a.HandleFunc("/restore", restoreHandler).Methods(http.MethodPost)
+	// The store can only be accessed once the transaction log is replayed
+	s := r.NewRoute().Subrouter()
+	s.Use(replayMiddleware, auditMiddleware, writeMiddleware)
 	// Long-form path requests
-	r.HandleFunc("/v1/key/{key}", putHandler).Methods(http.MethodPut)
-	r.HandleFunc("/v1/key/{key}", getHandler).Methods(http.MethodGet)
-	r.HandleFunc("/v1/key/{key}", delHandler).Methods(http.MethodDelete)
+	s.HandleFunc("/v1/key/{key}", putHandler).Methods(http.MethodPut)
+	s.HandleFunc("/v1/key/{key}", getHandler).Methods(http.MethodGet)
+	s.HandleFunc("/v1/key/{key}", delHandler).Methods(http.MethodDelete)
+	s.HandleFunc("/v1/key/{key}/history", historyHandler).Methods(http.MethodGet)
+	s.HandleFunc("/v1/key/{key}/incr", incrHandler).Methods(http.MethodPost)
+	s.HandleFunc("/v1/key/{key}/decr", incrHandler).Methods(http.MethodPost)
+	s.HandleFunc("/v1/key/{key}/{operation:append|lpush|rpush|lpop|rpop|sadd|srem}", operationHandler).Methods(http.MethodPost)
+	s.HandleFunc("/v1/key/{key}/field/{field}", fieldPutHandler).Methods(http.MethodPut)
+	s.HandleFunc("/v1/key/{key}/field/{field}", fieldGetHandler).Methods(http.MethodGet)
+	s.HandleFunc("/v1/key/{key}/field/{field}", fieldDelHandler).Methods(http.MethodDelete)
+	// Namespaced path requests
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}", putHandler).Methods(http.MethodPut)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}", getHandler).Methods(http.MethodGet)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}", delHandler).Methods(http.MethodDelete)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}/history", historyHandler).Methods(http.MethodGet)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}/incr", incrHandler).Methods(http.MethodPost)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}/decr", incrHandler).Methods(http.MethodPost)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}/{operation:append|lpush|rpush|lpop|rpop|sadd|srem}", operationHandler).Methods(http.MethodPost)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}/field/{field}", fieldPutHandler).Methods(http.MethodPut)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}/field/{field}", fieldGetHandler).Methods(http.MethodGet)
+	s.HandleFunc("/v1/ns/{namespace}/key/{key}/field/{field}", fieldDelHandler).Methods(http.MethodDelete)
 	// Short-form path requests
-	r.HandleFunc("/{key}", putHandler).Methods(http.MethodPut)
-	r.HandleFunc("/{key}", getHandler).Methods(http.MethodGet)
-	r.HandleFunc("/{key}", delHandler).Methods(http.MethodDelete)
+	s.HandleFunc("/{key}", putHandler).Methods(http.MethodPut)
+	s.HandleFunc("/{key}", getHandler).Methods(http.MethodGet)
+	s.HandleFunc("/{key}", delHandler).Methods(http.MethodDelete)
+	r.Use(loggingMiddleware, tracingMiddleware, metricsMiddleware)
 	return r
 }
 
 // Run creates a mux.NewRouter and attaches handlers to it
 func Run() {
-	// Initialize the logger
-	txFilepath := "" // Left blank to use a postgres db
-	var err error
-	transact, err = transaction_logs.InitializeTransactionLog(txFilepath)
+	// Hold the namespaces in the configured storage engine
+	closeEngine, err := engines.Configure()
+	if err != nil {
+		panic(err)
+	}
+	defer closeEngine()
+	// Create the namespaces before their events are replayed
+	err = configureNamespaces(os.Getenv("VILE_NAMESPACES"))
 	if err != nil {
 		panic(err)
 	}
-	log.Printf("Using transaction log located at %s", txFilepath)
+	configureEviction(os.Getenv("VILE_EVICTION_LOG"))
+	// Set the number of versions kept for each key before replaying
+	if err := configureHistory(os.Getenv("VILE_HISTORY_RETENTION"), os.Getenv("VILE_HISTORY_TOMBSTONE_RETENTION")); err != nil {
+		panic(err)
+	}
+	// Record mutating requests in the audit log
+	adminToken = os.Getenv("VILE_ADMIN_TOKEN")
+	auditLog, err = audit.Open(getEnv("VILE_AUDIT_LOG", "audit.log"))
+	if err != nil {
+		panic(err)
+	}
+	defer auditLog.Close()
+	// Export traces, flushing any buffered spans when the server stops
+	shutdownTracing, err := configureTracing(context.Background(), os.Getenv("VILE_TRACING_EXPORTER"))
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+	// Initialize the logger in the background, so that the probes
+	// can be served while the transaction log is replayed
+	txFilepath := os.Getenv("VILE_TX_LOG") // Left blank to use a postgres db
+	go func() {
+		tl, err := transaction_logs.InitializeTransactionLog(txFilepath)
+		if err != nil {
+			slog.Error("Could not initialize transaction log", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Using transaction log", "path", txFilepath)
+		transact = tl
+		go watchLogger(tl)
+		replayed.Store(true)
+	}()
+	// Load the TLS certificate, which is reloaded whenever it is rotated
+	done := make(chan struct{})
+	defer close(done)
+	tlsConf, err := tlsConfig(
+		getEnv("VILE_TLS_CERT", "./keys/localhost.crt"),
+		getEnv("VILE_TLS_KEY", "./keys/localhost.key"),
+		os.Getenv("VILE_TLS_DEV") == "true",
+		done,
+	)
+	if err != nil {
+		slog.Error("Could not configure TLS", "error", err)
+		return
+	}
 	// Initialize the server
 	port := 8080
-	r := NewMux()
-	log.Printf("Ready to accept connections on vile server at https://localhost:%d\n\n", port)
-	err = http.ListenAndServeTLS(fmt.Sprintf(":%d", port), "./keys/localhost.crt", "./keys/localhost.key", r)
+	srv := &http.Server{
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   NewMux(),
+		TLSConfig: tlsConf,
+	}
+	slog.Info("Ready to accept connections on vile server", "url", fmt.Sprintf("https://localhost:%d", port))
+	// The certificate is provided by the TLS config rather than files
+	err = srv.ListenAndServeTLS("", "")
 	if err != nil {
-		fmt.Printf("error while listening and serving: %q", err)
+		slog.Error("Error while listening and serving", "error", err)
+	}
+}
+
+// getEnv returns the value of the environment variable
+// or the fallback if the variable is unset or empty
+func getEnv(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
 	}
+	return fallback
 }
 
 // replyTextContent wraps text content in a HTTP response and sends it
@@ -62,9 +170,24 @@ func replyTextContent(w http.ResponseWriter, r *http.Request, status int, conten
 	w.Write([]byte(content + "\n"))
 }
 
-// replyError wraps text content in an HTTP error response and sends it
-func replyError(w http.ResponseWriter, r *http.Request, status int, message string) {
-	log.Printf("%s %s: Error: %d %s", r.URL, r.Method, status, message)
+// replyJSON encodes content as JSON in a HTTP response and sends it
+func replyJSON(w http.ResponseWriter, r *http.Request, status int, content any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(content); err != nil {
+		logFrom(r).Error("Could not encode response", "error", err)
+	}
+}
+
+// replyError wraps text content in an HTTP error response and sends it, logging
+// the message along with any attributes, which are redacted if sensitive
+func replyError(w http.ResponseWriter, r *http.Request, status int, message string, attrs ...any) {
+	level := slog.LevelWarn
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs = append(attrs, "method", r.Method, "route", routeTemplate(r), "status", status)
+	logFrom(r).Log(r.Context(), level, message, attrs...)
 	http.Error(w, http.StatusText(status), status)
 }
 
@@ -81,58 +204,116 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 // putHandler expects to be called with a PUT request
 // for the "/v1/key/{}" resource
 func putHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received PUT request")
+	logFrom(r).Debug("Received PUT request")
 	// Get the variables from the path
 	key := mux.Vars(r)["key"]
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
 	// The request body has our value
 	value, err := io.ReadAll(r.Body)
 	defer r.Body.Close()
 	if err != nil {
-		replyError(w, r, http.StatusInternalServerError, "Could not ready request body")
+		replyError(w, r, http.StatusInternalServerError, "Could not read request body", "error", err)
 		return
 	}
-	if err = core.Put(key, string(value)); err != nil {
-		replyError(w, r, http.StatusInternalServerError, "Could not store value in vile")
+	// Record the event with the transaction logger while the store is
+	// locked, so that the log sequence matches the order writes are applied
+	modified := time.Now()
+	commit := func() uint64 {
+		seq := transact.WriteEvent(transaction_logs.Event{
+			EventType:    transaction_logs.EventPut,
+			Namespace:    ns,
+			Key:          key,
+			Value:        string(value),
+			Timestamp:    modified,
+			RequestID:    requestID(r.Context()),
+			TraceContext: trace.SpanContextFromContext(r.Context()),
+		})
+		auditFrom(r).sequence = seq
+		return seq
+	}
+	err = traceStore(r.Context(), "core.Put", ns, func() error {
+		return store.PutAt(key, string(value), modified, commit)
+	})
+	if err != nil {
+		if errors.Is(err, core.ErrQuotaExceeded) {
+			replyError(w, r, http.StatusInsufficientStorage, "Namespace quota exceeded", "namespace", ns)
+			return
+		}
+		replyError(w, r, http.StatusInternalServerError, "Could not store value in vile", "error", err)
 		return
 	}
-	// Record the event with the transaction logger
-	transact.WritePut(key, string(value))
 	msg := fmt.Sprintf("Successfully stored %s:%s", key, value)
 	replyTextContent(w, r, http.StatusCreated, msg)
 }
 
 // getHandler returns the value stored at the key localted at /v1/key/{}
 func getHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received GET request")
+	logFrom(r).Debug("Received GET request")
 	key := mux.Vars(r)["key"] // The name of the key we are getting the value of
-	value, err := core.Get(key)
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
+	// Earlier versions are read from the key's history
+	if r.URL.Query().Has("version") {
+		getVersion(w, r, ns, store)
+		return
+	}
+	var entry core.Entry
+	err := traceStore(r.Context(), "core.Get", ns, func() (err error) {
+		entry, err = store.GetEntry(key)
+		return err
+	})
 	if errors.Is(err, core.ErrNoSuchKey) {
-		msg := fmt.Sprintf("Could not find %s", key)
-		replyError(w, r, http.StatusNotFound, msg)
+		replyError(w, r, http.StatusNotFound, "Could not find key", "key", key)
 		return
 	}
 	if err != nil {
-		msg := fmt.Sprintf("Error while getting %s", key)
-		replyError(w, r, http.StatusInternalServerError, msg)
+		replyError(w, r, http.StatusInternalServerError, "Error while getting key", "key", key, "error", err)
 		return
 	}
-	replyTextContent(w, r, http.StatusOK, value)
+	if !entry.Modified.IsZero() {
+		w.Header().Set("Last-Modified", entry.Modified.UTC().Format(http.TimeFormat))
+	}
+	replyEntry(w, r, http.StatusOK, entry)
 }
 
 // delHandler removes the value of the key provided in the path
 func delHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Received DELETE request")
+	logFrom(r).Debug("Received DELETE request")
 	key := mux.Vars(r)["key"]
-	if err := core.Delete(key); err != nil {
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
+	// Record the event with the transaction logger while the store is locked
+	modified := time.Now()
+	commit := func() uint64 {
+		seq := transact.WriteEvent(transaction_logs.Event{
+			EventType:    transaction_logs.EventDelete,
+			Namespace:    ns,
+			Key:          key,
+			Timestamp:    modified,
+			RequestID:    requestID(r.Context()),
+			TraceContext: trace.SpanContextFromContext(r.Context()),
+		})
+		auditFrom(r).sequence = seq
+		return seq
+	}
+	err := traceStore(r.Context(), "core.Delete", ns, func() error {
+		return store.DeleteAt(key, modified, commit)
+	})
+	if err != nil {
 		if errors.Is(err, core.ErrNoSuchKey) {
-			replyError(w, r, http.StatusNotFound, "The requested key could not be found")
+			replyError(w, r, http.StatusNotFound, "The requested key could not be found", "key", key)
 			return
 		}
-		replyError(w, r, http.StatusInternalServerError, "Something went wrong :(")
+		replyError(w, r, http.StatusInternalServerError, "Something went wrong :(", "key", key, "error", err)
 		return
 	}
-	// Record the event with the transaction logger
-	transact.WriteDelete(key)
 	msg := fmt.Sprintf("Successfully deleted entry %s", key)
 	replyTextContent(w, r, http.StatusOK, msg)
 }
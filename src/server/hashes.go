@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"rohitsingh/vile/core"
+	"rohitsingh/vile/transaction_logs"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fieldGetHandler returns the value of a field of the hash stored at the key
+func fieldGetHandler(w http.ResponseWriter, r *http.Request) {
+	key, field := mux.Vars(r)["key"], mux.Vars(r)["field"]
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
+	var value string
+	err := traceStore(r.Context(), "core.Get", ns, func() error {
+		entry, err := store.GetEntry(key)
+		if err != nil {
+			return err
+		}
+		value, err = entry.Field(field)
+		return err
+	})
+	switch {
+	case errors.Is(err, core.ErrNoSuchKey), errors.Is(err, core.ErrNoSuchField):
+		replyError(w, r, http.StatusNotFound, "Could not find field", "key", key, "field", field)
+	case errors.Is(err, core.ErrWrongType):
+		replyError(w, r, http.StatusConflict, "Value is of the wrong type", "key", key, "error", err)
+	case err != nil:
+		replyError(w, r, http.StatusInternalServerError, "Error while getting field", "key", key, "error", err)
+	default:
+		replyTextContent(w, r, http.StatusOK, value)
+	}
+}
+
+// fieldPutHandler sets a field of the hash stored at the key to the request
+// body, creating the hash if the key doesn't exist. Only the field is logged,
+// so concurrent writes to other fields of the hash are kept
+func fieldPutHandler(w http.ResponseWriter, r *http.Request) {
+	key, field := mux.Vars(r)["key"], mux.Vars(r)["field"]
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
+	value, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Could not read request body", "error", err)
+		return
+	}
+	err = updateField(r, ns, store, transaction_logs.Event{
+		EventType: transaction_logs.EventHashSet,
+		Key:       key,
+		Field:     field,
+		Value:     string(value),
+	})
+	switch {
+	case errors.Is(err, core.ErrWrongType):
+		replyError(w, r, http.StatusConflict, "Value is of the wrong type", "key", key, "error", err)
+	case errors.Is(err, core.ErrQuotaExceeded):
+		replyError(w, r, http.StatusInsufficientStorage, "Namespace quota exceeded", "namespace", ns)
+	case err != nil:
+		replyError(w, r, http.StatusInternalServerError, "Could not store field in vile", "key", key, "error", err)
+	default:
+		replyTextContent(w, r, http.StatusCreated, fmt.Sprintf("Successfully stored %s.%s:%s", key, field, value))
+	}
+}
+
+// fieldDelHandler removes a field of the hash stored at the key
+func fieldDelHandler(w http.ResponseWriter, r *http.Request) {
+	key, field := mux.Vars(r)["key"], mux.Vars(r)["field"]
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
+	err := updateField(r, ns, store, transaction_logs.Event{
+		EventType: transaction_logs.EventHashDelete,
+		Key:       key,
+		Field:     field,
+	})
+	switch {
+	case errors.Is(err, core.ErrNoSuchKey), errors.Is(err, core.ErrNoSuchField):
+		replyError(w, r, http.StatusNotFound, "Could not find field", "key", key, "field", field)
+	case errors.Is(err, core.ErrWrongType):
+		replyError(w, r, http.StatusConflict, "Value is of the wrong type", "key", key, "error", err)
+	case err != nil:
+		replyError(w, r, http.StatusInternalServerError, "Could not delete field", "key", key, "error", err)
+	default:
+		replyTextContent(w, r, http.StatusOK, fmt.Sprintf("Successfully deleted field %s.%s", key, field))
+	}
+}
+
+// updateField applies the hash operation of the event to the key, logging
+// the event while the key is locked
+func updateField(r *http.Request, ns string, store *core.Store, e transaction_logs.Event) error {
+	modified := time.Now()
+	e.Namespace, e.Timestamp = ns, modified
+	e.RequestID, e.TraceContext = requestID(r.Context()), trace.SpanContextFromContext(r.Context())
+	update, _ := e.Operation()
+	commit := func(string) uint64 {
+		store.NoteOperation()
+		seq := transact.WriteEvent(e)
+		auditFrom(r).sequence = seq
+		return seq
+	}
+	return traceStore(r.Context(), "core.Update", ns, func() error {
+		_, err := store.UpdateAt(e.Key, update, modified, commit)
+		return err
+	})
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rohitsingh/vile/transaction_logs"
+)
+
+// unhealthyPeriod is how long the transaction logger is considered
+// unhealthy after it reports an error
+const unhealthyPeriod = 30 * time.Second
+
+// replayed is set once the transaction log has been replayed into
+// the store and the transaction logger is accepting events
+var replayed atomic.Bool
+
+// loggerHealth records the most recent error reported by the transaction logger
+var loggerHealth struct {
+	sync.RWMutex
+	err error     // Most recent error reported by the logger
+	at  time.Time // Time the most recent error was reported
+}
+
+// watchLogger consumes the errors reported by the transaction logger,
+// recording them so that they are reflected by the readiness probe
+func watchLogger(tl transaction_logs.TransactionLogger) {
+	for err := range tl.Err() {
+		attrs := []any{"error", err}
+		var eventErr *transaction_logs.EventError
+		if errors.As(err, &eventErr) {
+			attrs = append(attrs, "request_id", eventErr.RequestID, "namespace", eventErr.Namespace)
+		}
+		slog.Error("Transaction logger error", attrs...)
+		loggerHealth.Lock()
+		loggerHealth.err, loggerHealth.at = err, time.Now()
+		loggerHealth.Unlock()
+	}
+}
+
+// checkReady returns an error describing why the server
+// is not ready to accept requests, or nil if it is ready
+func checkReady() error {
+	if !replayed.Load() {
+		return fmt.Errorf("transaction log is being replayed")
+	}
+	loggerHealth.RLock()
+	err, at := loggerHealth.err, loggerHealth.at
+	loggerHealth.RUnlock()
+	if err != nil && time.Since(at) < unhealthyPeriod {
+		return fmt.Errorf("transaction logger reported an error %s ago: %w",
+			time.Since(at).Round(time.Second), err)
+	}
+	if err := transact.Ping(); err != nil {
+		return fmt.Errorf("transaction log is unreachable: %w", err)
+	}
+	return nil
+}
+
+// healthzHandler is the liveness probe, which succeeds
+// whenever the server is able to handle requests
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	replyTextContent(w, r, http.StatusOK, "ok")
+}
+
+// readyzHandler is the readiness probe, which succeeds once the transaction
+// log has been replayed and only while the transaction logger is healthy
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := checkReady(); err != nil {
+		logFrom(r).Warn("Readiness check failed", "error", err)
+		replyTextContent(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	replyTextContent(w, r, http.StatusOK, "ready")
+}
+
+// replayMiddleware rejects requests to the store until the
+// transaction log has been replayed
+func replayMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !replayed.Load() {
+			replyError(w, r, http.StatusServiceUnavailable, "Transaction log is being replayed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"rohitsingh/vile/core"
+
+	"github.com/gorilla/mux"
+)
+
+// historyVersion type is a version of a key as returned by the history endpoint
+type historyVersion struct {
+	Sequence uint64         `json:"sequence"`           // Sequence of the transaction log event
+	Value    string         `json:"value,omitempty"`    // Value written by the version
+	Type     core.ValueType `json:"type,omitempty"`     // Type of the value written by the version
+	Modified time.Time      `json:"modified,omitempty"` // Time the version was written
+	Deleted  bool           `json:"deleted,omitempty"`  // Whether the version deleted the key
+}
+
+// historyHandler returns the retained versions of the key, oldest first
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	ns, store, ok := namespaceStore(w, r)
+	if !ok {
+		return
+	}
+	var versions []core.Version
+	err := traceStore(r.Context(), "core.History", ns, func() (err error) {
+		versions, err = store.History(key)
+		return err
+	})
+	if errors.Is(err, core.ErrNoSuchKey) {
+		replyError(w, r, http.StatusNotFound, "Could not find key history", "key", key)
+		return
+	}
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Error while getting key history", "key", key, "error", err)
+		return
+	}
+	history := make([]historyVersion, 0, len(versions))
+	for _, v := range versions {
+		history = append(history, historyVersion{
+			Sequence: v.Sequence,
+			Value:    v.Value,
+			Type:     v.Type,
+			Modified: v.Modified.UTC(),
+			Deleted:  v.Deleted,
+		})
+	}
+	replyJSON(w, r, http.StatusOK, history)
+}
+
+// getVersion replies with the version of the key written by the
+// transaction log event with the sequence in the version query parameter
+func getVersion(w http.ResponseWriter, r *http.Request, ns string, store *core.Store) {
+	key := mux.Vars(r)["key"]
+	sequence, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		replyError(w, r, http.StatusBadRequest, "Invalid version", "error", err)
+		return
+	}
+	var v core.Version
+	err = traceStore(r.Context(), "core.GetVersion", ns, func() (err error) {
+		v, err = store.GetVersion(key, sequence)
+		return err
+	})
+	if errors.Is(err, core.ErrNoSuchVersion) || v.Deleted {
+		replyError(w, r, http.StatusNotFound, "Could not find key version", "key", key, "version", sequence)
+		return
+	}
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Error while getting key version", "key", key, "error", err)
+		return
+	}
+	if !v.Modified.IsZero() {
+		w.Header().Set("Last-Modified", v.Modified.UTC().Format(http.TimeFormat))
+	}
+	replyEntry(w, r, http.StatusOK, v.Entry)
+}
+
+// configureHistory sets the number of versions kept for each key from
+// VILE_HISTORY_RETENTION, and how long the history of deleted keys is kept
+// from VILE_HISTORY_TOMBSTONE_RETENTION, keeping the defaults if they are unset
+func configureHistory(retention, tombstones string) error {
+	if retention != "" {
+		n, err := strconv.Atoi(retention)
+		if err != nil || n < 0 {
+			return errors.New("VILE_HISTORY_RETENTION must be a non-negative integer")
+		}
+		core.SetHistoryRetention(n)
+	}
+	if tombstones != "" {
+		d, err := time.ParseDuration(tombstones)
+		if err != nil || d < 0 {
+			return errors.New("VILE_HISTORY_TOMBSTONE_RETENTION must be a non-negative duration")
+		}
+		core.SetTombstoneRetention(d)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sensitiveAttrs are the log attributes that may contain user data
+var sensitiveAttrs = map[string]bool{"key": true, "field": true, "value": true}
+
+// contextKey type prevents collisions with context values set by other packages
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota // Context key of the request's ID
+	loggerKey                      // Context key of the request's logger
+	auditKey                       // Context key of the request's auditInfo
+)
+
+// ConfigureLogging replaces the default logger with a structured logger configured
+// by VILE_LOG_LEVEL (debug, info, warn or error), VILE_LOG_FORMAT (json or text)
+// and VILE_LOG_REDACT, which can be set to false to log keys, fields and values
+func ConfigureLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("VILE_LOG_LEVEL", "info"))); err != nil {
+		level = slog.LevelInfo
+	}
+	logger := slog.New(newLogHandler(
+		os.Stderr,
+		level,
+		getEnv("VILE_LOG_FORMAT", "json") == "text",
+		os.Getenv("VILE_LOG_REDACT") != "false",
+	))
+	slog.SetDefault(logger)
+}
+
+// newLogHandler creates a slog.Handler writing to w at the provided level,
+// redacting sensitive attributes such as keys, fields and values if redact is set
+func newLogHandler(w io.Writer, level slog.Level, text bool, redact bool) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if redact {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if sensitiveAttrs[a.Key] {
+				return slog.String(a.Key, "[REDACTED]")
+			}
+			return a
+		}
+	}
+	if text {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// newRequestID generates a random ID for a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID of the request the context belongs to
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// logFrom returns the logger of the request, which
+// annotates each record with the request's ID
+func logFrom(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// loggingMiddleware assigns each request an ID, taken from the X-Request-ID
+// header if provided, and logs the outcome of every request
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := strings.TrimSpace(r.Header.Get("X-Request-ID"))
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		logger := slog.Default().With("request_id", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, loggerKey, logger)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		// Log the route rather than the path, which contains the key
+		logger.Info("Handled request",
+			"method", r.Method,
+			"route", routeTemplate(r),
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+// routeTemplate returns the path template of the route that matched
+// the request, which unlike the path doesn't contain keys
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
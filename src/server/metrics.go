@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"rohitsingh/vile/core"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// requestsTotal counts the requests handled by each route
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "vile",
+	Subsystem: "http",
+	Name:      "requests_total",
+	Help:      "Number of HTTP requests handled, by route, method and status code.",
+}, []string{"handler", "method", "code"})
+
+// requestDuration records how long each route takes to handle requests
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "vile",
+	Subsystem: "http",
+	Name:      "request_duration_seconds",
+	Help:      "Time taken to handle HTTP requests, by route, method and status code.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"handler", "method", "code"})
+
+// The transaction logger is created once the log is replayed, so its
+// gauges read the current logger each time they are collected
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Namespace: "vile",
+	Subsystem: "transaction_log",
+	Name:      "queue_depth",
+	Help:      "Number of events waiting to be written to the transaction log.",
+}, func() float64 {
+	if !replayed.Load() {
+		return 0
+	}
+	return float64(transact.QueueDepth())
+})
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Namespace: "vile",
+	Subsystem: "transaction_log",
+	Name:      "last_sequence",
+	Help:      "Sequence number of the last event written to the transaction log.",
+}, func() float64 {
+	if !replayed.Load() {
+		return 0
+	}
+	return float64(transact.LastSequence())
+})
+
+func init() {
+	prometheus.MustRegister(storeCollector{})
+}
+
+// storeCollector type reports the size of each namespace's store
+type storeCollector struct{}
+
+var (
+	storeKeysDesc = prometheus.NewDesc("vile_store_keys",
+		"Number of keys held by the store.", []string{"namespace"}, nil)
+	storeBytesDesc = prometheus.NewDesc("vile_store_bytes",
+		"Approximate number of key and value bytes held by the store.", []string{"namespace"}, nil)
+	storeEvictionsDesc = prometheus.NewDesc("vile_store_evictions_total",
+		"Number of keys evicted from the store by its eviction policy.", []string{"namespace"}, nil)
+)
+
+// Describe sends the descriptors of the store metrics
+func (storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storeKeysDesc
+	ch <- storeBytesDesc
+	ch <- storeEvictionsDesc
+}
+
+// Collect sends the current size of every namespace's store
+func (storeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range core.Namespaces() {
+		store, err := core.Namespace(name)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(storeKeysDesc, prometheus.GaugeValue, float64(store.Len()), name)
+		ch <- prometheus.MustNewConstMetric(storeBytesDesc, prometheus.GaugeValue, float64(store.Size()), name)
+		ch <- prometheus.MustNewConstMetric(storeEvictionsDesc, prometheus.CounterValue, float64(store.Evictions()), name)
+	}
+}
+
+// statusRecorder type wraps a http.ResponseWriter to record the status code
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code before sending it
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// metricsMiddleware records the count and duration of requests
+// handled by each route of the router
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		// Label by route template rather than path to bound the number of series
+		handler := routeTemplate(r)
+		code := strconv.Itoa(rec.status)
+		requestsTotal.WithLabelValues(handler, r.Method, code).Inc()
+		requestDuration.WithLabelValues(handler, r.Method, code).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rohitsingh/vile/core"
+	"rohitsingh/vile/transaction_logs"
+
+	"github.com/gorilla/mux"
+)
+
+// configureNamespaces creates the namespaces described by spec, a comma-separated list
+// of name[:token[:maxKeys[:maxBytes[:eviction]]]] entries, e.g. "team-a:secret:1000:1048576".
+// The eviction policy, lru or lfu, evicts keys rather than rejecting writes exceeding
+// the quota. The default namespace can also be configured, except for its token
+func configureNamespaces(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		if len(fields) > 5 {
+			return fmt.Errorf("invalid namespace configuration %q", entry)
+		}
+		name := fields[0]
+		var opts core.NamespaceOptions
+		if len(fields) > 1 {
+			opts.Token = fields[1]
+		}
+		limits := []*int{&opts.Quota.MaxKeys, &opts.Quota.MaxBytes}
+		if len(fields) > 4 {
+			policy, err := core.ParseEvictionPolicy(fields[4])
+			if err != nil {
+				return fmt.Errorf("invalid namespace configuration %q: %w", entry, err)
+			}
+			opts.Quota.Eviction = policy
+			fields = fields[:4]
+		}
+		for i := 2; i < len(fields); i++ {
+			// Empty limits aren't enforced, so that a policy can be set without them
+			if fields[i] == "" {
+				continue
+			}
+			limit, err := strconv.Atoi(fields[i])
+			if err != nil || limit < 0 {
+				return fmt.Errorf("invalid quota in namespace configuration %q", entry)
+			}
+			*limits[i-2] = limit
+		}
+		if name == core.DefaultNamespace {
+			// The default namespace is open to requests without a namespace
+			if opts.Token != "" {
+				return fmt.Errorf("the default namespace cannot require a token")
+			}
+			if err := core.ConfigureNamespace(name, opts); err != nil {
+				return fmt.Errorf("cannot configure namespace %q: %w", name, err)
+			}
+			continue
+		}
+		if _, err := core.CreateNamespace(name, opts); err != nil {
+			return fmt.Errorf("cannot create namespace %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// configureEviction logs keys evicted from namespaces with an eviction policy
+// as deletions if logEvictions is "true", so that they stay evicted after a
+// restart. Otherwise evictions aren't logged, and keys evicted before a restart
+// are evicted again once the transaction log has been replayed. Evictions from
+// namespaces written by typed operations are always logged, as the operations
+// are replayed against the values the keys held when they were applied
+func configureEviction(logEvictions string) {
+	core.SetEvictionHook(func(ns, key string, modified time.Time) uint64 {
+		// Keys evicted while the log is replayed are evicted again on the next replay
+		if !replayed.Load() {
+			return 0
+		}
+		if logEvictions != "true" {
+			if store, err := core.Namespace(ns); err != nil || !store.Operations() {
+				return 0
+			}
+		}
+		return transact.WriteEvent(transaction_logs.Event{
+			EventType: transaction_logs.EventDelete,
+			Namespace: ns,
+			Key:       key,
+			Timestamp: modified,
+		})
+	})
+}
+
+// namespaceStore returns the namespace addressed by the request and its store,
+// replying with an error and returning false if it cannot be accessed
+func namespaceStore(w http.ResponseWriter, r *http.Request) (string, *core.Store, bool) {
+	name, ok := mux.Vars(r)["namespace"]
+	if !ok {
+		name = core.DefaultNamespace
+	}
+	auditFrom(r).namespace = name
+	store, err := core.Namespace(name)
+	if errors.Is(err, core.ErrNoSuchNamespace) {
+		replyError(w, r, http.StatusNotFound, "Could not find namespace", "namespace", name)
+		return "", nil, false
+	}
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Error while finding namespace", "namespace", name, "error", err)
+		return "", nil, false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !core.Authorize(name, token) {
+		replyError(w, r, http.StatusUnauthorized, "Not authorized for namespace", "namespace", name)
+		return "", nil, false
+	}
+	// Requests are identified by the namespace credential they used,
+	// provided the namespace requires one
+	if token != "" && !core.Authorize(name, "") {
+		auditFrom(r).identity = "token:" + name
+	}
+	return name, store, true
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"rohitsingh/vile/transaction_logs"
+)
+
+// writeMiddleware holds off recoveries and restores while mutating
+// requests are handled, and blocks those requests while one is applied
+func writeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		done := transaction_logs.BeginWrite()
+		defer done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverHandler restores the store to its state as of the sequence or
+// time (RFC 3339) provided in the query parameters of the same names
+func recoverHandler(w http.ResponseWriter, r *http.Request) {
+	var point transaction_logs.RecoveryPoint
+	var err error
+	q := r.URL.Query()
+	if v := q.Get("sequence"); v != "" {
+		if point.Sequence, err = strconv.ParseUint(v, 10, 64); err != nil {
+			replyError(w, r, http.StatusBadRequest, "Invalid recovery sequence")
+			return
+		}
+	}
+	if v := q.Get("time"); v != "" {
+		if point.Time, err = time.Parse(time.RFC3339, v); err != nil {
+			replyError(w, r, http.StatusBadRequest, "Invalid recovery time")
+			return
+		}
+	}
+	if point.Sequence == 0 && point.Time.IsZero() {
+		replyError(w, r, http.StatusBadRequest, "A recovery sequence or time is required")
+		return
+	}
+	result, err := transaction_logs.Recover(transact, point)
+	if errors.Is(err, transaction_logs.ErrNoTransactionLog) {
+		replyError(w, r, http.StatusConflict, "Recovery requires a transaction log")
+		return
+	}
+	if err != nil {
+		replyError(w, r, http.StatusInternalServerError, "Could not recover store", "error", err)
+		return
+	}
+	logFrom(r).Warn("Recovered store",
+		"sequence", result.Sequence, "puts", result.Puts, "deletes", result.Deletes)
+	replyJSON(w, r, http.StatusOK, result)
+}
@@ -2,16 +2,30 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"rohitsingh/vile/audit"
 
 	// server needs transaction_logs access to record
 	// HTTP request history in the transaction log
 	"rohitsingh/vile/transaction_logs"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // tester is a generic test interface that can be used
@@ -42,6 +56,7 @@ func setupAPI(t tester) (string, func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	replayed.Store(true)
 	return ts.URL, func() {
 		ts.Close()
 		os.Remove(file.Name())
@@ -128,6 +143,25 @@ func delHelper(t tester, delUrl string, expCode int) *http.Response {
 	return resp
 }
 
+// authHelper sends a request with the provided bearer token
+// and checks the returned status code
+func authHelper(t tester, method string, reqUrl string, token string, val string, expCode int) *http.Response {
+	req, err := http.NewRequest(method, reqUrl, bytes.NewBuffer([]byte(val)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != expCode {
+		t.Fatalf("Expected %q, got %q.", http.StatusText(expCode),
+			http.StatusText(resp.StatusCode))
+	}
+	return resp
+}
+
 // TestGet tests HTTP get method on the server's root
 func TestGet(t *testing.T) {
 	testCases := []struct {
@@ -194,11 +228,461 @@ func TestIntegration(t *testing.T) {
 		path := url + p + key
 		// PUT the value in the store
 		_ = putHelper(t, path, val, http.StatusCreated)
-		// GET the stored value
-		_ = getHelper(t, path, val, http.StatusOK)
+		// GET the stored value, which should report when it was modified
+		resp := getHelper(t, path, val, http.StatusOK)
+		if _, err := http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+			t.Fatalf("expected Last-Modified header, instead got %q", resp.Header.Get("Last-Modified"))
+		}
 		// DELETE the value
 		_ = delHelper(t, path, http.StatusOK)
 		// GET the value, but expect to fail since it was deleted.
 		_ = getHelper(t, path, "", http.StatusNotFound)
 	}
 }
+
+func TestNamespaces(t *testing.T) {
+	if err := configureNamespaces("server-a:token-a:1,server-b"); err != nil {
+		t.Fatalf("unexpected error while configuring namespaces: %q", err)
+	}
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	nsA, nsB := url+"/v1/ns/server-a/key/", url+"/v1/ns/server-b/key/"
+	// Requests without the namespace's token are rejected
+	_ = putHelper(t, nsA+"key", "val", http.StatusUnauthorized)
+	_ = authHelper(t, http.MethodPut, nsA+"key", "token-a", "val", http.StatusCreated)
+	_ = authHelper(t, http.MethodGet, nsA+"key", "token-a", "", http.StatusOK)
+	// The quota of one key is enforced
+	_ = authHelper(t, http.MethodPut, nsA+"other", "token-a", "val", http.StatusInsufficientStorage)
+	// Keys are isolated between namespaces
+	_ = getHelper(t, nsB+"key", "", http.StatusNotFound)
+	_ = getHelper(t, url+"/v1/key/key", "", http.StatusNotFound)
+	// Unknown namespaces cannot be used
+	_ = putHelper(t, url+"/v1/ns/unknown/key/key", "val", http.StatusNotFound)
+}
+
+func TestEvictingNamespace(t *testing.T) {
+	if err := configureNamespaces("server-cache::2::lru"); err != nil {
+		t.Fatalf("unexpected error while configuring namespaces: %q", err)
+	}
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	ns := url + "/v1/ns/server-cache/key/"
+	// Writes beyond the quota evict the least recently used key
+	for _, key := range []string{"a", "b", "c"} {
+		_ = putHelper(t, ns+key, "val", http.StatusCreated)
+	}
+	_ = getHelper(t, ns+"a", "", http.StatusNotFound)
+	_ = getHelper(t, ns+"c", "val", http.StatusOK)
+	_ = getHelper(t, url+"/metrics", `vile_store_evictions_total{namespace="server-cache"} 1`, http.StatusOK)
+}
+
+func TestCounters(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	key := url + "/v1/key/counterKey"
+	// Missing keys are treated as 0
+	_ = authHelper(t, http.MethodPost, key+"/incr", "", "", http.StatusOK)
+	_ = authHelper(t, http.MethodPost, key+"/incr?by=10", "", "", http.StatusOK)
+	_ = authHelper(t, http.MethodPost, key+"/decr?by=3", "", "", http.StatusOK)
+	_ = getHelper(t, key, "8", http.StatusOK)
+	_ = authHelper(t, http.MethodPost, key+"/incr?by=ten", "", "", http.StatusBadRequest)
+	// Concurrent increments aren't lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Post(key+"/incr", "text/plain", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	_ = getHelper(t, key, "18", http.StatusOK)
+	// Values that aren't integers can't be incremented
+	_ = putHelper(t, key, "eighteen", http.StatusCreated)
+	_ = authHelper(t, http.MethodPost, key+"/incr", "", "", http.StatusConflict)
+}
+
+func TestCollections(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	key := url + "/v1/key/collectionKey"
+	// Values can be appended to, starting from an empty string
+	_ = authHelper(t, http.MethodPost, url+"/v1/key/appendKey/append", "", "ab", http.StatusOK)
+	_ = authHelper(t, http.MethodPost, url+"/v1/key/appendKey/append", "", "cd", http.StatusOK)
+	_ = getHelper(t, url+"/v1/key/appendKey", "abcd", http.StatusOK)
+	// Lists are returned as JSON arrays
+	_ = authHelper(t, http.MethodPost, key+"/rpush", "", "b", http.StatusOK)
+	_ = authHelper(t, http.MethodPost, key+"/rpush", "", "c", http.StatusOK)
+	resp := authHelper(t, http.MethodPost, key+"/lpush", "", "a", http.StatusOK)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("X-Vile-Type") != "list" || strings.TrimSpace(string(body)) != `["a","b","c"]` {
+		t.Errorf("expected list [a b c], instead got %q %q", resp.Header.Get("X-Vile-Type"), body)
+	}
+	resp = authHelper(t, http.MethodPost, key+"/rpop", "", "", http.StatusOK)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.TrimSpace(string(body)) != "c" {
+		t.Errorf("expected c to be popped, instead got %q", body)
+	}
+	// Operations on values of another type are conflicts
+	_ = authHelper(t, http.MethodPost, key+"/sadd", "", "x", http.StatusConflict)
+	_ = authHelper(t, http.MethodPost, key+"/incr", "", "", http.StatusConflict)
+	_ = authHelper(t, http.MethodPost, url+"/v1/key/missingList/lpop", "", "", http.StatusNotFound)
+	// Sets hold each member once
+	set := url + "/v1/ns/default/key/setKey"
+	for _, member := range []string{"y", "x", "y"} {
+		_ = authHelper(t, http.MethodPost, set+"/sadd", "", member, http.StatusOK)
+	}
+	resp = authHelper(t, http.MethodPost, set+"/srem", "", "z", http.StatusOK)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.TrimSpace(string(body)) != `["x","y"]` {
+		t.Errorf("expected set [x y], instead got %q", body)
+	}
+	// The operation is logged with its operand
+	transact.Wait()
+	events, errs := transact.ReadEventsAfter(transact.LastSequence() - 1)
+	for e := range events {
+		if e.EventType != transaction_logs.EventSetRemove || e.Value != "z" {
+			t.Errorf("expected the operand of srem to be logged, instead got %+v", e)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashes(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	key := url + "/v1/key/hashKey"
+	// Concurrent writes to different fields are all kept
+	var wg sync.WaitGroup
+	for _, field := range []string{"name", "email", "role"} {
+		wg.Add(1)
+		go func(field string) {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPut, key+"/field/"+field, strings.NewReader(field+"-value"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(field)
+	}
+	wg.Wait()
+	_ = getHelper(t, key+"/field/email", "email-value", http.StatusOK)
+	_ = authHelper(t, http.MethodDelete, key+"/field/email", "", "", http.StatusOK)
+	_ = getHelper(t, key+"/field/email", "", http.StatusNotFound)
+	_ = authHelper(t, http.MethodDelete, key+"/field/email", "", "", http.StatusNotFound)
+	resp := getHelper(t, key, "", http.StatusOK)
+	if resp.Header.Get("X-Vile-Type") != "hash" {
+		t.Errorf("expected a hash, instead got %q", resp.Header.Get("X-Vile-Type"))
+	}
+	// Field writes are logged with only the field and its value
+	_ = putHelper(t, key+"/field/name", "renamed", http.StatusCreated)
+	transact.Wait()
+	events, errs := transact.ReadEventsAfter(transact.LastSequence() - 1)
+	for e := range events {
+		if e.EventType != transaction_logs.EventHashSet || e.Field != "name" || e.Value != "renamed" {
+			t.Errorf("expected only the field to be logged, instead got %+v", e)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	// Fields of other types of values can't be accessed
+	_ = putHelper(t, url+"/v1/key/plainKey", "plain", http.StatusCreated)
+	_ = putHelper(t, url+"/v1/key/plainKey/field/a", "1", http.StatusConflict)
+	_ = getHelper(t, url+"/v1/key/plainKey/field/a", "", http.StatusConflict)
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/vile.crt", dir+"/vile.key"
+	// writeCert generates a new certificate and writes it to disk
+	writeCert := func(modTime time.Time) []byte {
+		certPEM, keyPEM, err := generateSelfSigned(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for f, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+			if err := os.WriteFile(f, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(f, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		block, _ := pem.Decode(certPEM)
+		return block.Bytes
+	}
+	// A missing certificate is an error unless using dev mode
+	if _, err := tlsConfig(certFile, keyFile, false, nil); err == nil {
+		t.Fatal("expected error for missing certificate, instead got nil")
+	}
+	if _, err := tlsConfig(certFile, keyFile, true, nil); err != nil {
+		t.Fatalf("unexpected error while generating self-signed certificate: %q", err)
+	}
+	// The self-signed certificate should be regenerated once it is due
+	s, err := newSelfSigned(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	initial, _ := s.GetCertificate(nil)
+	if cert, _ := s.GetCertificate(nil); cert != initial {
+		t.Fatal("expected the self-signed certificate to be kept until it is due")
+	}
+	s.renewAt = time.Now().Add(-time.Second)
+	if cert, _ := s.GetCertificate(nil); cert == initial {
+		t.Fatal("expected the self-signed certificate to be regenerated")
+	}
+	// The reloader should serve the certificate on disk
+	first := writeCert(time.Now().Add(-time.Hour))
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, _ := reloader.GetCertificate(nil); !bytes.Equal(cert.Certificate[0], first) {
+		t.Fatal("reloader did not serve the certificate on disk")
+	}
+	// Rotating the certificate should cause it to be reloaded
+	second := writeCert(time.Now())
+	if reloaded, err := reloader.reload(); err != nil || !reloaded {
+		t.Fatalf("expected certificate to be reloaded, instead got %v (%v)", reloaded, err)
+	}
+	if cert, _ := reloader.GetCertificate(nil); !bytes.Equal(cert.Certificate[0], second) {
+		t.Fatal("reloader did not serve the rotated certificate")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	_ = putHelper(t, url+"/v1/key/metricsKey", "val", http.StatusCreated)
+	_ = getHelper(t, url+"/v1/key/metricsKey", "val", http.StatusOK)
+	// Requests should be counted by route template rather than path
+	metrics := []string{
+		`vile_http_requests_total{code="201",handler="/v1/key/{key}",method="PUT"}`,
+		`vile_store_keys{namespace="default"}`,
+		"vile_transaction_log_queue_depth",
+		"vile_transaction_log_write_duration_seconds_count",
+	}
+	for _, m := range metrics {
+		_ = getHelper(t, url+"/metrics", m, http.StatusOK)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	_ = getHelper(t, url+"/healthz", "ok", http.StatusOK)
+	_ = getHelper(t, url+"/readyz", "ready", http.StatusOK)
+	// Errors reported by the logger make the server unready
+	loggerHealth.Lock()
+	loggerHealth.err, loggerHealth.at = errors.New("disk full"), time.Now()
+	loggerHealth.Unlock()
+	_ = getHelper(t, url+"/readyz", "disk full", http.StatusServiceUnavailable)
+	loggerHealth.Lock()
+	loggerHealth.err = nil
+	loggerHealth.Unlock()
+	// The store is unavailable while the transaction log is replayed
+	replayed.Store(false)
+	defer replayed.Store(true)
+	_ = getHelper(t, url+"/healthz", "ok", http.StatusOK)
+	_ = getHelper(t, url+"/readyz", "replayed", http.StatusServiceUnavailable)
+	_ = getHelper(t, url+"/v1/key/probeKey", "", http.StatusServiceUnavailable)
+}
+
+func TestRequestLogging(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	// Capture the logs written while handling requests
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(newLogHandler(&logs, slog.LevelDebug, false, true)))
+	// A request ID provided by the client should be echoed and logged
+	req, err := http.NewRequest(http.MethodGet, url+"/v1/key/secretKey", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-ID", "test-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Request-ID"); id != "test-request" {
+		t.Fatalf("expected request ID %q, instead got %q", "test-request", id)
+	}
+	_ = getHelper(t, url+"/v1/key/secretKey/field/secretField", "", http.StatusNotFound)
+	// Requests without an ID should be assigned one
+	resp = getHelper(t, url+"/healthz", "ok", http.StatusOK)
+	if resp.Header.Get("X-Request-ID") == "" {
+		t.Fatal("expected request ID to be generated")
+	}
+	if !strings.Contains(logs.String(), `"request_id":"test-request"`) {
+		t.Fatalf("expected request ID in logs, instead got %s", logs.String())
+	}
+	// Keys and fields should be redacted from the logs
+	if strings.Contains(logs.String(), "secretKey") || strings.Contains(logs.String(), "secretField") {
+		t.Fatalf("expected key and field to be redacted from logs, instead got %s", logs.String())
+	}
+}
+
+func TestTracing(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	// Record spans in memory
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+	if _, err := configureTracing(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	// The trace context propagated by the client should be continued
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodPut, url+"/v1/key/tracedKey", strings.NewReader("val"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	transact.Wait()
+	spans := map[string]bool{}
+	for _, s := range exporter.GetSpans() {
+		if s.SpanContext.TraceID().String() == traceID {
+			spans[s.Name] = true
+		}
+	}
+	expected := []string{"PUT /v1/key/{key}", "core.Put", "transaction_log.enqueue", "transaction_log.write"}
+	for _, name := range expected {
+		if !spans[name] {
+			t.Errorf("expected span %q in trace, instead got %v", name, spans)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	var err error
+	auditLog, err = audit.Open(t.TempDir() + "/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminToken = "admin-secret"
+	defer func() {
+		auditLog.Close()
+		auditLog, adminToken = nil, ""
+	}()
+	// Mutating requests are audited, reads are not
+	_ = putHelper(t, url+"/v1/key/auditKey", "val", http.StatusCreated)
+	_ = getHelper(t, url+"/v1/key/auditKey", "val", http.StatusOK)
+	_ = delHelper(t, url+"/v1/key/auditKey", http.StatusOK)
+	_ = putHelper(t, url+"/v1/key/auditKey/field/name", "val", http.StatusCreated)
+	// The admin API requires the admin token
+	_ = getHelper(t, url+"/v1/admin/audit", "", http.StatusUnauthorized)
+	resp := authHelper(t, http.MethodGet, url+"/v1/admin/audit?key=auditKey", "admin-secret", "", http.StatusOK)
+	defer resp.Body.Close()
+	var records []audit.Record
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 audit records, instead got %d", len(records))
+	}
+	// Operations are recorded by their route, along with the field
+	for i, op := range []string{"PUT /v1/key/{key}", "DELETE /v1/key/{key}", "PUT /v1/key/{key}/field/{field}"} {
+		r := records[i]
+		if r.Operation != op || r.Namespace != "default" || r.SourceIP == "" || r.Sequence == 0 {
+			t.Errorf("unexpected audit record %+v", r)
+		}
+	}
+	if records[2].Field != "name" {
+		t.Errorf("expected the field to be recorded, instead got %q", records[2].Field)
+	}
+	if records[1].Sequence <= records[0].Sequence {
+		t.Errorf("expected increasing sequences, instead got %d and %d", records[0].Sequence, records[1].Sequence)
+	}
+}
+
+func TestRecoverEndpoint(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	adminToken = "admin-secret"
+	defer func() { adminToken = "" }()
+	path := url + "/v1/key/recoverKey"
+	_ = putHelper(t, path, "original", http.StatusCreated)
+	_ = putHelper(t, path, "overwritten", http.StatusCreated)
+	transact.Wait()
+	// A recovery point is required
+	_ = authHelper(t, http.MethodPost, url+"/v1/admin/recover", "admin-secret", "", http.StatusBadRequest)
+	seq := strconv.FormatUint(transact.LastSequence()-1, 10)
+	_ = authHelper(t, http.MethodPost, url+"/v1/admin/recover?sequence="+seq, "admin-secret", "", http.StatusOK)
+	_ = getHelper(t, path, "original", http.StatusOK)
+}
+
+func TestKeyHistory(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	path := url + "/v1/key/historyKey"
+	_ = putHelper(t, path, "first", http.StatusCreated)
+	_ = putHelper(t, path, "second", http.StatusCreated)
+	r, err := http.Get(path + "/history")
+	if err != nil {
+		t.Fatalf("error while sending GET request: %q", err)
+	}
+	defer r.Body.Close()
+	var history []historyVersion
+	if err := json.NewDecoder(r.Body).Decode(&history); err != nil {
+		t.Fatalf("cannot decode history: %q", err)
+	}
+	if len(history) != 2 || history[0].Value != "first" || history[1].Value != "second" {
+		t.Fatalf("unexpected history: %+v", history)
+	}
+	// Earlier versions can be read by their sequence
+	version := strconv.FormatUint(history[0].Sequence, 10)
+	_ = getHelper(t, path+"?version="+version, "first", http.StatusOK)
+	_ = getHelper(t, path+"?version=0", "", http.StatusNotFound)
+	_ = getHelper(t, path+"?version=latest", "", http.StatusBadRequest)
+	_ = getHelper(t, url+"/v1/key/missingKey/history", "", http.StatusNotFound)
+}
+
+func TestBackupEndpoints(t *testing.T) {
+	url, cleanup := setupAPI(t)
+	defer cleanup()
+	adminToken = "admin-secret"
+	defer func() { adminToken = "" }()
+	path := url + "/v1/key/backupKey"
+	_ = putHelper(t, path, "backedUp", http.StatusCreated)
+	r := authHelper(t, http.MethodGet, url+"/v1/admin/backup", "admin-secret", "", http.StatusOK)
+	backup, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(backup), `{"format":"vile-backup"`) {
+		t.Fatalf("unexpected backup %q", backup)
+	}
+	_ = putHelper(t, path, "overwritten", http.StatusCreated)
+	_ = authHelper(t, http.MethodPost, url+"/v1/admin/restore", "admin-secret", string(backup), http.StatusOK)
+	_ = getHelper(t, path, "backedUp", http.StatusOK)
+	_ = authHelper(t, http.MethodPost, url+"/v1/admin/restore", "admin-secret", "not a backup", http.StatusBadRequest)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader type serves a TLS certificate loaded from disk, reloading
+// it whenever the certificate or key files are modified
+type certReloader struct {
+	sync.RWMutex
+	certFile string           // Path of the PEM encoded certificate
+	keyFile  string           // Path of the PEM encoded private key
+	cert     *tls.Certificate // Certificate currently being served
+	modTime  time.Time        // Latest modification time of the loaded files
+}
+
+// newCertReloader creates a certReloader and loads the initial certificate,
+// returning an error if the certificate cannot be loaded
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, it satisfies
+// the tls.Config GetCertificate field
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// Watch checks the certificate files for changes every interval, reloading
+// them when they are modified, until the done channel is closed
+func (c *certReloader) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				// Keep serving the previous certificate until the files are fixed
+				slog.Warn("Could not reload TLS certificate", "error", err)
+				continue
+			}
+			if reloaded {
+				slog.Info("Reloaded TLS certificate", "path", c.certFile)
+			}
+		}
+	}
+}
+
+// reload loads the certificate if the files have been modified since
+// they were last loaded, and reports whether the certificate changed
+func (c *certReloader) reload() (bool, error) {
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.RLock()
+	unchanged := c.cert != nil && !modTime.After(c.modTime)
+	c.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.cert, c.modTime = &cert, modTime
+	return true, nil
+}
+
+// latestModTime returns the most recent modification time of the files
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, fmt.Errorf("cannot read TLS file: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// selfSigned type serves an ephemeral self-signed certificate, generating a
+// new one once half of the current certificate's validity has passed, so that
+// a long running development server never serves an expired certificate
+type selfSigned struct {
+	sync.Mutex
+	validFor time.Duration    // How long each certificate is valid for
+	cert     *tls.Certificate // Certificate currently being served
+	renewAt  time.Time        // Time the certificate is replaced
+}
+
+// newSelfSigned creates a selfSigned and generates the initial certificate
+func newSelfSigned(validFor time.Duration) (*selfSigned, error) {
+	s := &selfSigned{validFor: validFor}
+	if _, err := s.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetCertificate returns the current certificate, generating a new one if it is
+// due to be renewed. It satisfies the tls.Config GetCertificate field
+func (s *selfSigned) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.cert != nil && time.Now().Before(s.renewAt) {
+		return s.cert, nil
+	}
+	cert, err := selfSignedCertificate(s.validFor)
+	if err != nil {
+		return nil, err
+	}
+	s.cert, s.renewAt = cert, time.Now().Add(s.validFor/2)
+	return cert, nil
+}
+
+// selfSignedCertificate generates an ephemeral certificate for localhost,
+// it is only intended for development when no certificate is configured
+func selfSignedCertificate(validFor time.Duration) (*tls.Certificate, error) {
+	certPEM, keyPEM, err := generateSelfSigned(validFor)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load self-signed certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// generateSelfSigned creates a PEM encoded certificate and
+// private key for localhost that is valid for the provided duration
+func generateSelfSigned(validFor time.Duration) ([]byte, []byte, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot generate private key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot generate serial number: %w", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"vile development"}},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot encode private key: %w", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// tlsConfig creates the TLS configuration of the server, serving the certificate
+// files and reloading them when modified. If devMode is set and the files are
+// missing an ephemeral self-signed certificate is served instead, which is
+// regenerated before it expires
+func tlsConfig(certFile string, keyFile string, devMode bool, done <-chan struct{}) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err == nil {
+		go reloader.Watch(10*time.Second, done)
+		return &tls.Config{GetCertificate: reloader.GetCertificate}, nil
+	}
+	if !devMode {
+		return nil, err
+	}
+	slog.Warn("Using an ephemeral self-signed certificate", "error", err)
+	s, err := newSelfSigned(24 * time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: s.GetCertificate}, nil
+}
@@ -0,0 +1,157 @@
+package transaction_logs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"rohitsingh/vile/core"
+)
+
+// BackupFormat identifies a vile backup in its header
+const BackupFormat = "vile-backup"
+
+// BackupVersion is the version of the backup format written by WriteBackup,
+// backups written by newer versions are refused by Restore
+const BackupVersion = 2
+
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// BackupHeader type is the first line of a backup. A backup is a file of JSON
+// lines, starting with the header and followed by one BackupRecord for each key,
+// so that it can be read independently of the transaction log backend
+type BackupHeader struct {
+	Format   string    `json:"format"`   // Always BackupFormat
+	Version  int       `json:"version"`  // Version of the backup format
+	Created  time.Time `json:"created"`  // Time the snapshot was taken
+	Sequence uint64    `json:"sequence"` // Last transaction log sequence included
+	NodeID   string    `json:"node"`     // ID of the node that took the snapshot
+}
+
+// BackupRecord type is the value of a single key in a backup
+type BackupRecord struct {
+	Namespace string         `json:"ns"`                 // Namespace of the key
+	Key       string         `json:"key"`                // Key the value is stored at
+	Value     string         `json:"value"`              // Value, encrypted if KeyID is set
+	Type      core.ValueType `json:"type,omitempty"`     // Type of the value, added in version 2
+	KeyID     string         `json:"kid,omitempty"`      // ID of the key the value is encrypted with
+	Modified  time.Time      `json:"modified,omitempty"` // Time the value was last written
+	Sequence  uint64         `json:"seq,omitempty"`      // Sequence of the event that wrote the value
+}
+
+// WriteBackup writes a consistent snapshot of every namespace to w. The snapshot
+// is copied before it is written, so writers aren't blocked while it is streamed.
+// Values are encrypted if server-side encryption is enabled
+func WriteBackup(w io.Writer, tl TransactionLogger) (BackupHeader, error) {
+	snapshot, sequence, err := core.Snapshot(tl.LastSequence)
+	header := BackupHeader{
+		Format:   BackupFormat,
+		Version:  BackupVersion,
+		Created:  time.Now().UTC(),
+		Sequence: sequence,
+		NodeID:   nodeID,
+	}
+	if err != nil {
+		return header, fmt.Errorf("cannot take snapshot: %w", err)
+	}
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	if err := enc.Encode(header); err != nil {
+		return header, fmt.Errorf("cannot write backup header: %w", err)
+	}
+	// Records are sorted so that backups of the same state are identical
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		keys := make([]string, 0, len(snapshot[name]))
+		for key := range snapshot[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry := snapshot[name][key]
+			value, keyID, err := core.Encrypt(entry.Value)
+			if err != nil {
+				return header, fmt.Errorf("cannot encrypt backup record: %w", err)
+			}
+			err = enc.Encode(BackupRecord{
+				Namespace: name,
+				Key:       key,
+				Value:     value,
+				Type:      entry.Type,
+				KeyID:     keyID,
+				Modified:  entry.Modified.UTC(),
+				Sequence:  entry.Sequence,
+			})
+			if err != nil {
+				return header, fmt.Errorf("cannot write backup record: %w", err)
+			}
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return header, fmt.Errorf("cannot write backup: %w", err)
+	}
+	return header, nil
+}
+
+// Restore makes every namespace match the backup read from r. Like recovery,
+// the differences from the current state are written as new events, so the
+// restore is persisted by whichever transaction log backend is in use. The
+// backup is read completely before the store is modified
+func Restore(tl TransactionLogger, r io.Reader) (RecoveryResult, error) {
+	var result RecoveryResult
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var header BackupHeader
+	if err := dec.Decode(&header); err != nil {
+		return result, fmt.Errorf("%w: cannot read header: %v", ErrInvalidBackup, err)
+	}
+	if header.Format != BackupFormat {
+		return result, fmt.Errorf("%w: unknown format %q", ErrInvalidBackup, header.Format)
+	}
+	if header.Version < 1 || header.Version > BackupVersion {
+		return result, fmt.Errorf("%w: unsupported version %d", ErrInvalidBackup, header.Version)
+	}
+	result.Sequence = header.Sequence
+	target := map[string]map[string]Event{}
+	for {
+		var record BackupRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("%w: cannot read record: %v", ErrInvalidBackup, err)
+		}
+		value, err := core.Decrypt(record.Value, record.KeyID)
+		if err != nil {
+			return result, fmt.Errorf("cannot decrypt backup record: %w", err)
+		}
+		name := record.Namespace
+		if name == "" {
+			name = core.DefaultNamespace
+		}
+		if target[name] == nil {
+			target[name] = map[string]Event{}
+		}
+		if _, err := core.ParseValueType(string(record.Type)); err != nil {
+			return result, fmt.Errorf("%w: %v", ErrInvalidBackup, err)
+		}
+		target[name][record.Key] = Event{
+			EventType: EventPut,
+			Namespace: name,
+			Key:       record.Key,
+			Value:     value,
+			ValueType: record.Type,
+			Timestamp: record.Modified,
+		}
+	}
+	err := apply(tl, target, &result)
+	return result, err
+}
@@ -1,12 +1,84 @@
 package transaction_logs
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	// Event values are encrypted at rest using the keys held by core
+	"rohitsingh/vile/core"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
 // Event type contains the information to be logged by
 // a TransactionLogger interface
 type Event struct {
-	Sequence  uint64    // Unique record ID
-	EventType EventType // Action taken in event
-	Key       string    // Key affected by this event
-	Value     string    // Value PUT by this event (only for PUTs)
+	Sequence  uint64         `json:"seq"`             // Unique record ID
+	EventType EventType      `json:"type"`            // Action taken in event
+	Namespace string         `json:"ns,omitempty"`    // Namespace the key belongs to
+	Key       string         `json:"key"`             // Key affected by this event
+	Field     string         `json:"field,omitempty"` // Field of the hash affected by this event, if any
+	Value     string         `json:"value,omitempty"` // Value PUT by this event, or the operand of a typed operation
+	ValueType core.ValueType `json:"vtype,omitempty"` // Type of the value PUT by this event
+	KeyID     string         `json:"kid,omitempty"`   // ID of the key the value is encrypted with, empty if unencrypted
+	Timestamp time.Time      `json:"ts,omitempty"`    // Wall-clock time of the event, zero for events logged by earlier versions
+	NodeID    string         `json:"node,omitempty"`  // ID of the node that logged the event
+	RequestID string         `json:"-"`               // ID of the request that caused the event, never persisted
+	// TraceContext identifies the span of the request that caused the event
+	TraceContext trace.SpanContext `json:"-"`
+}
+
+// EventError type describes an event that could not be persisted,
+// identifying it without including its key or value
+type EventError struct {
+	Sequence  uint64 // Sequence assigned to the event, if any
+	Namespace string // Namespace the event was recorded in
+	RequestID string // ID of the request that caused the event
+	Err       error  // Reason the event could not be persisted
+}
+
+// newEventError wraps err with the identifying details of the event
+func newEventError(e Event, err error) *EventError {
+	return &EventError{Sequence: e.Sequence, Namespace: e.Namespace, RequestID: e.RequestID, Err: err}
+}
+
+// Error returns the reason the event could not be persisted
+func (e *EventError) Error() string {
+	if e.RequestID == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("request %s: %s", e.RequestID, e.Err)
+}
+
+// Unwrap returns the reason the event could not be persisted
+func (e *EventError) Unwrap() error {
+	return e.Err
+}
+
+// nodeID identifies this node in the events it logs, it is
+// loaded from VILE_NODE_ID and defaults to the hostname
+var nodeID = func() string {
+	if id := os.Getenv("VILE_NODE_ID"); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}()
+
+// stamp returns a copy of the event recording when and where it was logged,
+// keeping the timestamp if it was already set by the caller
+func (e Event) stamp() Event {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	e.Timestamp = e.Timestamp.UTC()
+	e.NodeID = nodeID
+	return e
 }
 
 // EventType type assigns a byte-value to each possible event
@@ -14,7 +86,84 @@ type Event struct {
 type EventType byte
 
 const (
-	_                     = iota
-	EventDelete EventType = iota // EventType corresponding to a DELETE action
-	EventPut                     // Eventype corresponding to a PUT action
+	_                         = iota
+	EventDelete     EventType = iota // EventType corresponding to a DELETE action
+	EventPut                         // Eventype corresponding to a PUT action
+	EventAppend                      // EventType appending the value to a string
+	EventPushFront                   // EventType pushing the value to the front of a list
+	EventPushBack                    // EventType pushing the value to the back of a list
+	EventPopFront                    // EventType popping the element at the front of a list
+	EventPopBack                     // EventType popping the element at the back of a list
+	EventSetAdd                      // EventType adding the value to a set
+	EventSetRemove                   // EventType removing the value from a set
+	EventHashSet                     // EventType setting a field of a hash to the value
+	EventHashDelete                  // EventType removing a field of a hash
 )
+
+// Operation returns the operation applied to the key by an event of a typed
+// operation, and whether the event is one. The operations only depend on the
+// key's previous value, so replaying the events always gives the same result
+func (e Event) Operation() (core.Update, bool) {
+	switch e.EventType {
+	case EventAppend:
+		return core.Append(e.Value), true
+	case EventPushFront, EventPushBack:
+		return core.Push(e.Value, e.EventType == EventPushFront), true
+	case EventPopFront, EventPopBack:
+		return core.Pop(e.EventType == EventPopFront, new(string)), true
+	case EventSetAdd:
+		return core.SetAdd(e.Value), true
+	case EventSetRemove:
+		return core.SetRemove(e.Value), true
+	case EventHashSet:
+		return core.HashSet(e.Field, e.Value), true
+	case EventHashDelete:
+		return core.HashDelete(e.Field), true
+	}
+	return nil, false
+}
+
+// encrypt returns a copy of the event with its value encrypted at rest
+func (e Event) encrypt() (Event, error) {
+	if e.Value == "" {
+		return e, nil
+	}
+	value, keyID, err := core.Encrypt(e.Value)
+	if err != nil {
+		return e, fmt.Errorf("cannot encrypt event: %w", err)
+	}
+	e.Value, e.KeyID = value, keyID
+	return e, nil
+}
+
+// decrypt returns a copy of the event with its value decrypted
+func (e Event) decrypt() (Event, error) {
+	value, err := core.Decrypt(e.Value, e.KeyID)
+	if err != nil {
+		return e, fmt.Errorf("cannot decrypt event %d: %w", e.Sequence, err)
+	}
+	e.Value, e.KeyID = value, ""
+	return e, nil
+}
+
+// tracer creates the spans of events being queued and persisted
+var tracer = otel.Tracer("rohitsingh/vile/transaction_logs")
+
+// startSpan starts a span for the event as a child of the request that caused it
+func (e Event) startSpan(name string) trace.Span {
+	ctx := trace.ContextWithSpanContext(context.Background(), e.TraceContext)
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.Int("vile.event_type", int(e.EventType)),
+		attribute.String("vile.namespace", e.Namespace),
+	))
+	return span
+}
+
+// endSpan ends the span, recording the error if the event could not be persisted
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
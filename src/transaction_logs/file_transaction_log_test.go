@@ -1,9 +1,15 @@
 package transaction_logs
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"rohitsingh/vile/core"
 )
 
 func fileExists(filename string) bool {
@@ -16,8 +22,7 @@ func fileExists(filename string) bool {
 
 func TestCreateFileLogger(t *testing.T) {
 	// Create a temp file to store log
-	const filename = "/tmp/file-logger-test.log"
-	defer os.Remove(filename)
+	filename := t.TempDir() + "/file-logger-test.log"
 	// Create the file logger
 	logger, err := NewFileTransactionLogger(filename)
 	if err != nil {
@@ -42,8 +47,7 @@ func evaluateLastSequence(t *testing.T, el TransactionLogger, expected uint64) {
 func TestWritePut(t *testing.T) {
 	// Create a transaction logger
 	// Create a temp file to store log
-	const filename = "/tmp/file-logger-test.log"
-	defer os.Remove(filename)
+	filename := t.TempDir() + "/file-logger-test.log"
 	// Create the file logger
 	logger, err := NewFileTransactionLogger(filename)
 	if err != nil {
@@ -64,8 +68,7 @@ func TestWritePut(t *testing.T) {
 }
 
 func TestWriteAppend(t *testing.T) {
-	const filename = "/tmp/write-append.txt"
-	defer os.Remove(filename)
+	filename := t.TempDir() + "/write-append.txt"
 
 	tl, err := NewFileTransactionLogger(filename)
 	if err != nil {
@@ -111,3 +114,330 @@ func TestWriteAppend(t *testing.T) {
 		t.Errorf("Last sequence mismatch (expected 4; got %d)", tl2.LastSequence())
 	}
 }
+
+func TestReplayNamespaces(t *testing.T) {
+	filename := t.TempDir() + "/replay-namespaces.log"
+	// Lines written by earlier versions are tab-separated and have no namespace
+	legacy := "1\t2\tlegacy-key\tlegacy value\n"
+	if err := os.WriteFile(filename, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.WriteEvent(Event{EventType: EventPut, Namespace: "replay-test", Key: "key", Value: "val"})
+	tl.Wait()
+	tl.Close()
+
+	tl2, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	if v, err := core.Get("legacy-key"); err != nil || v != "legacy value" {
+		t.Errorf("expected legacy value from default namespace, got %q (%v)", v, err)
+	}
+	ns, err := core.Namespace("replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ns.Get("key"); err != nil || v != "val" {
+		t.Errorf("expected val from replay-test namespace, got %q (%v)", v, err)
+	}
+	if tl2.LastSequence() != 2 {
+		t.Errorf("Last sequence mismatch (expected 2; got %d)", tl2.LastSequence())
+	}
+}
+
+func TestFastReplay(t *testing.T) {
+	filename := t.TempDir() + "/fast-replay.log"
+	// Small chunks split lines between chunks and parse them concurrently
+	defer func(size int) { replayChunkSize = size }(replayChunkSize)
+	replayChunkSize = 64
+	tl, err := NewFileTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i%10)
+		if i%10 == 9 {
+			tl.WriteEvent(Event{EventType: EventDelete, Namespace: "fast-replay", Key: key})
+		} else {
+			tl.WriteEvent(Event{EventType: EventPut, Namespace: "fast-replay", Key: key, Value: fmt.Sprint(i)})
+		}
+	}
+	tl.Wait()
+	tl.Close()
+
+	tl2, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	if tl2.LastSequence() != 200 {
+		t.Errorf("Last sequence mismatch (expected 200; got %d)", tl2.LastSequence())
+	}
+	ns, err := core.Namespace("fast-replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := ns.Get("key-3"); err != nil || v != "193" {
+		t.Errorf("expected the last value 193, got %q (%v)", v, err)
+	}
+	if _, err := ns.Get("key-9"); !errors.Is(err, core.ErrNoSuchKey) {
+		t.Errorf("expected key-9 to be deleted, got %v", err)
+	}
+	versions, err := ns.History("key-3")
+	if err != nil || len(versions) != core.DefaultHistoryRetention || versions[len(versions)-1].Sequence != 194 {
+		t.Errorf("expected %d versions ending with sequence 194, got %+v (%v)", core.DefaultHistoryRetention, versions, err)
+	}
+}
+
+func TestReplayOperations(t *testing.T) {
+	filename := t.TempDir() + "/replay-operations.log"
+	tl, err := NewFileTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+	events := []Event{
+		{EventType: EventPut, Key: "str", Value: "a"},
+		{EventType: EventAppend, Key: "str", Value: "b"},
+		{EventType: EventPushBack, Key: "list", Value: "2"},
+		{EventType: EventPushFront, Key: "list", Value: "1"},
+		{EventType: EventPushBack, Key: "list", Value: "3"},
+		{EventType: EventPopFront, Key: "list"},
+		{EventType: EventSetAdd, Key: "set", Value: "y"},
+		{EventType: EventSetAdd, Key: "set", Value: "x"},
+		{EventType: EventSetRemove, Key: "set", Value: "y"},
+		{EventType: EventHashSet, Key: "hash", Field: "b", Value: "2"},
+		{EventType: EventHashSet, Key: "hash", Field: "a", Value: "1"},
+		{EventType: EventHashDelete, Key: "hash", Field: "b"},
+		// The string was evicted without the eviction being logged before the
+		// list was pushed to, so the push is skipped rather than failing the replay
+		{EventType: EventPut, Key: "evicted", Value: "text"},
+		{EventType: EventPushBack, Key: "evicted", Value: "1"},
+	}
+	for _, e := range events {
+		e.Namespace = "replay-operations"
+		tl.WriteEvent(e)
+	}
+	tl.Wait()
+	tl.Close()
+
+	tl2, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	ns, err := core.Namespace("replay-operations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]core.Entry{
+		"str":     {Value: "ab"},
+		"list":    {Value: `["2","3"]`, Type: core.TypeList},
+		"set":     {Value: `["x"]`, Type: core.TypeSet},
+		"hash":    {Value: `{"a":"1"}`, Type: core.TypeHash},
+		"evicted": {Value: "text"},
+	}
+	for key, exp := range expected {
+		if e, err := ns.GetEntry(key); err != nil || e.Value != exp.Value || e.Type != exp.Type {
+			t.Errorf("expected %s to be %s %q, instead got %s %q (%v)", key, exp.Type, exp.Value, e.Type, e.Value, err)
+		}
+	}
+	// Evictions from the namespace must now be logged
+	if !ns.Operations() {
+		t.Error("expected the namespace to record that it is written by operations")
+	}
+	// Recovering replays the operations up to the recovery point
+	if _, err := Recover(tl2, RecoveryPoint{Sequence: 4}); err != nil {
+		t.Fatalf("unexpected error while recovering: %q", err)
+	}
+	tl2.Wait()
+	if e, err := ns.GetEntry("list"); err != nil || e.Value != `["1","2"]` || e.Type != core.TypeList {
+		t.Errorf("expected list [1 2] to be recovered, instead got %s %q (%v)", e.Type, e.Value, err)
+	}
+	if _, err := ns.GetEntry("set"); !errors.Is(err, core.ErrNoSuchKey) {
+		t.Errorf("expected set to be removed, instead got %v", err)
+	}
+}
+
+func TestEncryptedLog(t *testing.T) {
+	filename := t.TempDir() + "/encrypted-log.log"
+	defer core.SetEncryptionKeys("")
+	if err := core.SetEncryptionKeys("secret"); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.WritePut("encrypted-key", "plaintext-value")
+	tl.Wait()
+	tl.Close()
+	// The value should never be written to disk in plaintext
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "plaintext-value") {
+		t.Fatalf("value stored unencrypted: %s", contents)
+	}
+	// Replaying the log should restore the decrypted value
+	core.Delete("encrypted-key")
+	tl2, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	if v, err := core.Get("encrypted-key"); err != nil || v != "plaintext-value" {
+		t.Errorf("expected plaintext-value after replay, got %q (%v)", v, err)
+	}
+}
+
+func TestEventTimestamps(t *testing.T) {
+	filename := t.TempDir() + "/event-timestamps.log"
+	tl, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	tl.WriteEvent(Event{EventType: EventPut, Key: "stamped-key", Value: "val", Timestamp: modified})
+	tl.Wait()
+	tl.Close()
+	// The timestamp and node ID should be persisted with the event
+	tl2, err := NewFileTransactionLogger(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	events, errs := tl2.ReadEvents()
+	for e := range events {
+		if !e.Timestamp.Equal(modified) {
+			t.Errorf("expected timestamp %s, instead got %s", modified, e.Timestamp)
+		}
+		if e.NodeID != nodeID {
+			t.Errorf("expected node ID %q, instead got %q", nodeID, e.NodeID)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	filename := t.TempDir() + "/recover.log"
+	tl, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an accidental delete after the values were written
+	for _, key := range []string{"recover-key1", "recover-key2"} {
+		core.Put(key, "val")
+		tl.WritePut(key, "val")
+	}
+	core.Put("recover-key3", "later")
+	tl.WritePut("recover-key3", "later")
+	core.Delete("recover-key1")
+	tl.WriteDelete("recover-key1")
+	tl.Wait()
+	// Recovering waits for writes in progress
+	done := BeginWrite()
+	recovered := make(chan error)
+	var result RecoveryResult
+	go func() {
+		var err error
+		result, err = Recover(tl, RecoveryPoint{Sequence: 2})
+		recovered <- err
+	}()
+	select {
+	case <-recovered:
+		t.Fatal("expected recovery to wait for the write in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	done()
+	if err := <-recovered; err != nil {
+		t.Fatalf("unexpected error while recovering: %q", err)
+	}
+	tl.Wait()
+	tl.Close()
+	if result.Sequence != 2 || result.Puts != 1 {
+		t.Errorf("unexpected recovery result %+v", result)
+	}
+	// The recovered state should survive replaying the log from scratch
+	for _, key := range []string{"recover-key1", "recover-key2", "recover-key3"} {
+		core.Delete(key)
+	}
+	tl2, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl2.Close()
+	for _, key := range []string{"recover-key1", "recover-key2"} {
+		if v, err := core.Get(key); err != nil || v != "val" {
+			t.Errorf("expected %s to be recovered, got %q (%v)", key, v, err)
+		}
+	}
+	if _, err := core.Get("recover-key3"); !errors.Is(err, core.ErrNoSuchKey) {
+		t.Errorf("expected recover-key3 to be removed, instead got %v", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	filename := t.TempDir() + "/backup.log"
+	tl, err := InitializeTransactionLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+	ns, err := core.CreateNamespace("backup-test", core.NamespaceOptions{})
+	if errors.Is(err, core.ErrNamespaceExists) {
+		ns, err = core.Namespace("backup-test")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Put("backup-key1", "val1")
+	ns.Put("backup-key2", "val2")
+	original, _ := ns.GetEntry("backup-key1")
+	var backup bytes.Buffer
+	header, err := WriteBackup(&backup, tl)
+	if err != nil {
+		t.Fatalf("unexpected error while writing backup: %q", err)
+	}
+	if header.Format != BackupFormat || header.Version != BackupVersion {
+		t.Fatalf("unexpected backup header %+v", header)
+	}
+	// Changes made after the backup should be undone by restoring it
+	ns.Put("backup-key1", "changed")
+	ns.Delete("backup-key2")
+	ns.Put("backup-key3", "val3")
+	result, err := Restore(tl, bytes.NewReader(backup.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error while restoring backup: %q", err)
+	}
+	tl.Wait()
+	if result.Puts != 2 || result.Deletes != 1 {
+		t.Errorf("unexpected restore result %+v", result)
+	}
+	for key, exp := range map[string]string{"backup-key1": "val1", "backup-key2": "val2"} {
+		if v, err := ns.Get(key); err != nil || v != exp {
+			t.Errorf("expected %s to be restored to %q, got %q (%v)", key, exp, v, err)
+		}
+	}
+	if _, err := ns.Get("backup-key3"); !errors.Is(err, core.ErrNoSuchKey) {
+		t.Errorf("expected backup-key3 to be removed, instead got %v", err)
+	}
+	// Restored values keep the time they were written
+	if e, _ := ns.GetEntry("backup-key1"); !e.Modified.Equal(original.Modified) {
+		t.Errorf("expected modification time %v, instead got %v", original.Modified, e.Modified)
+	}
+	// Backups in other formats should be refused
+	_, err = Restore(tl, strings.NewReader(`{"format":"vile-backup","version":99}`))
+	if !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("expected %q, instead got %v", ErrInvalidBackup, err)
+	}
+}
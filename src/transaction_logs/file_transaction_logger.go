@@ -2,18 +2,25 @@ package transaction_logs
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // FileTransactionLogger is a struct that satisfies the TransactionLogger
-// interface, and writes logs to a file, with each log seperated by newlines
+// interface, and writes logs to a file, with each log seperated by newlines.
+// Each log is a JSON encoded Event, although tab-separated logs written by
+// earlier versions of vile can still be read
 type FileTransactionLogger struct {
 	events       chan<- Event // Write-only channel for sending events
 	errors       <-chan error // Read-only channel for receiving errors
 	lastSequence uint64       // The last recorded event sequence number
+	mu           sync.Mutex   // Guards lastSequence while events are queued
 	file         *os.File     // The location of the transaction log
 	wg           *sync.WaitGroup
 }
@@ -42,20 +49,37 @@ func (l *FileTransactionLogger) Run() {
 	// Run a goroutine to constantly handle new events coming over channels
 	go func() {
 		for e := range events {
-			l.lastSequence++
-			// Create the string to be written
-			eventString := fmt.Sprintf("%d\t%d\t%s\t%s\n",
-				l.lastSequence, e.EventType, e.Key, e.Value)
-			// Write the string to the file
-			_, err := l.file.Write([]byte(eventString))
+			span := e.startSpan("transaction_log.write")
+			err := l.write(e)
 			if err != nil {
-				errs <- fmt.Errorf("cannot write to log file: %w", err)
+				writeErrors.Inc()
+				errs <- newEventError(e, err)
 			}
+			endSpan(span, err)
 			l.wg.Done()
 		}
 	}()
 }
 
+// write method encrypts the event's value and writes the event to the log file
+func (l *FileTransactionLogger) write(e Event) error {
+	e, err := e.encrypt()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("cannot encode event: %w", err)
+	}
+	start := time.Now()
+	_, err = l.file.Write(append(line, '\n'))
+	writeDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("cannot write to log file: %w", err)
+	}
+	return nil
+}
+
 // ReadEvents method parses an existing log file and creates an event for each line
 // and broadcasts it over a read-only channel
 func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
@@ -66,7 +90,6 @@ func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 	restoredLines := 0                  // Used to check whether we restored from a txLog
 	// Create concurrent process to parse the TxLog and refill the data
 	go func() {
-		var e Event // Event object to store data parsed from log
 		// Close the channels when the goroutine ends
 		defer close(outEvent)
 		defer close(outError)
@@ -75,8 +98,14 @@ func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 			// Mark that we have restored data from the file
 			restoredLines++
 			// Parse through the line and create an event object
-			line := scanner.Text()
-			fmt.Sscanf(line, "%d\t%d\t%s\t%s", &e.Sequence, &e.EventType, &e.Key, &e.Value)
+			e, err := parseEvent(scanner.Text())
+			if err == nil {
+				e, err = e.decrypt()
+			}
+			if err != nil {
+				outError <- err
+				return
+			}
 			if l.lastSequence >= e.Sequence {
 				outError <- fmt.Errorf("transaction numbers out of sequence")
 				return
@@ -90,25 +119,107 @@ func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 			return
 		}
 		if restoredLines > 1 {
-			log.Print("Restored vile store from transaction log")
+			slog.Info("Restored vile store from transaction log", "events", restoredLines)
 		} else {
-			log.Print("No transaction log found, creating new vile store")
+			slog.Info("No transaction log found, creating new vile store")
 		}
 	}()
 
 	return outEvent, outError
 }
 
+// ReadEventsAfter method reads the events with a sequence greater than the provided
+// sequence from a separate handle of the log file, so it can be used while
+// the logger is running without affecting the events being written
+func (l *FileTransactionLogger) ReadEventsAfter(sequence uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)    // Unbuffered event channel to stream concurrent events
+	outError := make(chan error, 1) // Buffered error channel to stream concurrent errors
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+		file, err := os.Open(l.file.Name())
+		if err != nil {
+			outError <- fmt.Errorf("cannot open transaction log file: %w", err)
+			return
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			e, err := parseEvent(scanner.Text())
+			if err != nil {
+				outError <- err
+				return
+			}
+			if e.Sequence <= sequence {
+				continue
+			}
+			if e, err = e.decrypt(); err != nil {
+				outError <- err
+				return
+			}
+			outEvent <- e
+		}
+		if err := scanner.Err(); err != nil {
+			outError <- fmt.Errorf("transaction log read failure: %w", err)
+		}
+	}()
+	return outEvent, outError
+}
+
+// parseEvent creates an event from a single line of the log file
+func parseEvent(line string) (Event, error) {
+	var e Event
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return e, fmt.Errorf("cannot decode event: %w", err)
+		}
+		return e, nil
+	}
+	// Lines written by earlier versions are tab-separated
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) < 3 {
+		return e, fmt.Errorf("malformed transaction log line: %q", line)
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("malformed transaction log sequence: %w", err)
+	}
+	eventType, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("malformed transaction log event type: %w", err)
+	}
+	e.Sequence, e.EventType = seq, EventType(eventType)
+	e.Key = fields[2]
+	if len(fields) == 4 {
+		e.Value = fields[3]
+	}
+	return e, nil
+}
+
 // WritePut method logs PUT events for the provided key:value pair as a line in a log file
 func (l *FileTransactionLogger) WritePut(key, value string) {
-	l.wg.Add(1)
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
+	l.WriteEvent(Event{EventType: EventPut, Key: key, Value: value})
 }
 
 // WriteDelete method logs DELETE events for the provided key as a line in a log file
 func (l *FileTransactionLogger) WriteDelete(key string) {
+	l.WriteEvent(Event{EventType: EventDelete, Key: key})
+}
+
+// WriteEvent method logs the provided event as a line in a log file,
+// returning the sequence number assigned to the event
+func (l *FileTransactionLogger) WriteEvent(e Event) uint64 {
+	// Trace the time spent waiting for space in the events channel
+	span := e.startSpan("transaction_log.enqueue")
+	defer span.End()
 	l.wg.Add(1)
-	l.events <- Event{EventType: EventDelete, Key: key}
+	// Sequences are assigned while queueing so events are written in order
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastSequence++
+	e.Sequence = l.lastSequence
+	l.events <- e.stamp()
+	return e.Sequence
 }
 
 // Wait method waits for current threads to compelte
@@ -130,7 +241,20 @@ func (l *FileTransactionLogger) Err() <-chan error {
 	return l.errors
 }
 
+// QueueDepth method returns the number of events waiting to be written
+func (l *FileTransactionLogger) QueueDepth() int {
+	return len(l.events)
+}
+
+// Ping method checks that the log file is still accessible
+func (l *FileTransactionLogger) Ping() error {
+	_, err := l.file.Stat()
+	return err
+}
+
 // LastSequence method gets the last sequence of the txLog
 func (l *FileTransactionLogger) LastSequence() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return l.lastSequence
 }
@@ -3,6 +3,7 @@ package transaction_logs
 import (
 	"fmt"
 	"rohitsingh/vile/core"
+	"strings"
 )
 
 // transaction_logs needs core access to write to store when loading
@@ -11,48 +12,63 @@ import (
 // TransactionLogger interface defines the required
 // methods for a struct needed to serve as a transaction logger
 type TransactionLogger interface {
-	WriteDelete(key string)                   // WriteDelete logs DELETE events for a provided key
-	WritePut(key, value string)               // WritePut logs PUT events for a provided key:value pair
-	Err() <-chan error                        // Err returns any errors that have been read from the logger's error channel
-	ReadEvents() (<-chan Event, <-chan error) // ReadEvents parses the logfile and creates an event for each line
-	Run()                                     // Run starts the logger, accepts new events put over channels and writes them to the log
-	Wait()                                    // Wait waits for any concurrent threads to complete before unblocking
-	Close() error                             // Close gracefully closes the TransactionLogger
-	LastSequence() uint64                     // Returns the last sequence in a file txlog
+	WriteDelete(key string)                                       // WriteDelete logs DELETE events for a provided key
+	WritePut(key, value string)                                   // WritePut logs PUT events for a provided key:value pair
+	WriteEvent(e Event) uint64                                    // WriteEvent logs an event, such as one scoped to a namespace, returning its sequence
+	Err() <-chan error                                            // Err returns any errors that have been read from the logger's error channel
+	ReadEvents() (<-chan Event, <-chan error)                     // ReadEvents parses the logfile and creates an event for each line
+	ReadEventsAfter(sequence uint64) (<-chan Event, <-chan error) // ReadEventsAfter reads the events after a sequence while the logger runs
+	Run()                                                         // Run starts the logger, accepts new events put over channels and writes them to the log
+	Wait()                                                        // Wait waits for any concurrent threads to complete before unblocking
+	Close() error                                                 // Close gracefully closes the TransactionLogger
+	LastSequence() uint64                                         // Returns the last sequence in a file txlog
+	QueueDepth() int                                              // Returns the number of events waiting to be written
+	Ping() error                                                  // Ping checks that the log's storage is reachable
 }
 
 // initializeTransactionLog creates a TransactionLogger object, watches for events and logs
 // them accordingly
-// If filepath is an empty string, a postgres db is created instead
+// If filepath is an empty string, a postgres db is created instead, and if it
+// is prefixed with "sqlite:" the rest of the path is used as a sqlite db. If it
+// is "none" events aren't logged, which requires a durable storage backend
 func InitializeTransactionLog(filepath string) (TransactionLogger, error) {
+	// Events already persisted by a durable storage backend aren't replayed
+	checkpoint, err := core.Checkpoint()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read storage checkpoint: %w", err)
+	}
 	var transact TransactionLogger
-	var err error
-	if filepath == "" {
-		transact, err = NewPostgresTransactionLogger(PostgresDBConfig{
-			host:     "host.docker.internal",
-			dbName:   "vile",
-			user:     "test",
-			password: "password",
-		})
+	if filepath == "none" {
+		if !core.Durable() {
+			return nil, fmt.Errorf("%w: a durable storage engine is required", ErrNoTransactionLog)
+		}
+		return NewNopTransactionLogger(checkpoint), nil
+	} else if filepath == "" {
+		var config PostgresDBConfig
+		if config, err = PostgresConfigFromEnv(); err == nil {
+			transact, err = NewPostgresTransactionLogger(config)
+		}
+	} else if path, ok := strings.CutPrefix(filepath, "sqlite:"); ok {
+		transact, err = NewSQLiteTransactionLogger(path)
 	} else {
 		transact, err = NewFileTransactionLogger(filepath)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("unexpected error while creating event logger: %w", err)
 	}
-	events, errors := transact.ReadEvents()
-	e, ok := Event{}, true
-	for ok && err == nil {
-		select {
-		case err, ok = <-errors:
-		case e, ok = <-events:
-			switch e.EventType {
-			case EventDelete:
-				err = core.Delete(e.Key)
-			case EventPut:
-				err = core.Put(e.Key, e.Value)
-			}
-		}
+	// Events are folded into the final state of each key, which is loaded
+	// into the stores once, rather than applying each event in turn
+	r := newReplayer(checkpoint)
+	stop := r.report()
+	if fl, ok := transact.(*FileTransactionLogger); ok {
+		// The file logger finds its last sequence by reading every event
+		err = fl.replay(r)
+	} else {
+		err = r.read(transact.ReadEventsAfter(checkpoint))
+	}
+	stop()
+	if err == nil {
+		err = r.apply()
 	}
 	transact.Run()
 	return transact, err
@@ -0,0 +1,39 @@
+package transaction_logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// writeDuration records how long each event takes to be persisted
+var writeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "vile",
+	Subsystem: "transaction_log",
+	Name:      "write_duration_seconds",
+	Help:      "Time taken to persist an event to the transaction log.",
+	Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+})
+
+// writeErrors counts the events that could not be persisted
+var writeErrors = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "vile",
+	Subsystem: "transaction_log",
+	Name:      "write_errors_total",
+	Help:      "Number of events that could not be persisted to the transaction log.",
+})
+
+// writeRetries counts the writes that failed and will be retried
+var writeRetries = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "vile",
+	Subsystem: "transaction_log",
+	Name:      "write_retries_total",
+	Help:      "Number of failed writes to the transaction log that will be retried.",
+})
+
+// breakerOpen is 1 while the transaction log's circuit breaker is open
+var breakerOpen = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "vile",
+	Subsystem: "transaction_log",
+	Name:      "circuit_open",
+	Help:      "Whether the transaction log is unreachable and events are being buffered locally.",
+})
@@ -0,0 +1,8 @@
+-- The table created by the first versions of vile, which only
+-- recorded the type, key and value of each event
+CREATE TABLE IF NOT EXISTS {{table}} (
+	sequence   BIGSERIAL PRIMARY KEY,
+	event_type SMALLINT,
+	key        TEXT,
+	value      TEXT
+);
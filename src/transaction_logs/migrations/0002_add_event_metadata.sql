@@ -0,0 +1,7 @@
+-- Record the namespace of each event, the key used to encrypt
+-- its value, and when and where it happened
+ALTER TABLE {{table}}
+	ADD COLUMN IF NOT EXISTS namespace  TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS key_id     TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS event_time TIMESTAMPTZ,
+	ADD COLUMN IF NOT EXISTS node_id    TEXT NOT NULL DEFAULT '';
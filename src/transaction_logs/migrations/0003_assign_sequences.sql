@@ -0,0 +1,3 @@
+-- Sequences are assigned by vile when events are queued, so that they are
+-- known before the event is written, rather than by the column's default
+ALTER TABLE {{table}} ALTER COLUMN sequence DROP DEFAULT;
@@ -0,0 +1,3 @@
+-- Record the type of the values put by events, so that list
+-- and set values are restored with their type
+ALTER TABLE {{table}} ADD COLUMN IF NOT EXISTS value_type TEXT NOT NULL DEFAULT '';
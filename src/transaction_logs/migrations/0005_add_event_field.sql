@@ -0,0 +1,3 @@
+-- Record the field of the hash affected by each event, so that
+-- fields of the same hash are logged independently
+ALTER TABLE {{table}} ADD COLUMN IF NOT EXISTS field TEXT NOT NULL DEFAULT '';
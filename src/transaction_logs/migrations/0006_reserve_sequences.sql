@@ -0,0 +1,5 @@
+-- Sequences are reserved in blocks from the column's sequence by each node,
+-- so that nodes sharing the table never assign the same sequence. The default
+-- is restored and the sequence continues after the events already logged
+ALTER TABLE {{table}} ALTER COLUMN sequence SET DEFAULT nextval(pg_get_serial_sequence('{{table}}', 'sequence'));
+SELECT setval(pg_get_serial_sequence('{{table}}', 'sequence'), COALESCE(MAX(sequence), 0) + 1, false) FROM {{table}};
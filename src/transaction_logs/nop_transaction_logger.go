@@ -0,0 +1,87 @@
+package transaction_logs
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrNoTransactionLog = errors.New("transaction log is disabled")
+
+// NopTransactionLogger is a struct that satisfies the TransactionLogger interface
+// without persisting events, for use when a durable storage engine holds the data.
+// Sequences are still assigned so that entries and checkpoints stay ordered
+type NopTransactionLogger struct {
+	mu           sync.Mutex
+	lastSequence uint64 // The last assigned event sequence number
+}
+
+// NewNopTransactionLogger is a constructor for the NopTransactionLogger type,
+// it takes the sequence to continue from, usually the storage checkpoint
+func NewNopTransactionLogger(sequence uint64) *NopTransactionLogger {
+	return &NopTransactionLogger{lastSequence: sequence}
+}
+
+// Run method does nothing, as events aren't written
+func (l *NopTransactionLogger) Run() {}
+
+// ReadEvents method returns no events
+func (l *NopTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	return l.ReadEventsAfter(0)
+}
+
+// ReadEventsAfter method returns no events
+func (l *NopTransactionLogger) ReadEventsAfter(sequence uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error)
+	close(outEvent)
+	close(outError)
+	return outEvent, outError
+}
+
+// WritePut method discards PUT events for the provided key:value pair
+func (l *NopTransactionLogger) WritePut(key, value string) {
+	l.WriteEvent(Event{EventType: EventPut, Key: key, Value: value})
+}
+
+// WriteDelete method discards DELETE events for the provided key
+func (l *NopTransactionLogger) WriteDelete(key string) {
+	l.WriteEvent(Event{EventType: EventDelete, Key: key})
+}
+
+// WriteEvent method discards the provided event, returning the sequence it would have been assigned
+func (l *NopTransactionLogger) WriteEvent(e Event) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastSequence++
+	return l.lastSequence
+}
+
+// Err method returns a channel that never receives errors
+func (l *NopTransactionLogger) Err() <-chan error {
+	return nil
+}
+
+// Wait method returns immediately, as nothing is queued
+func (l *NopTransactionLogger) Wait() {}
+
+// Close method does nothing
+func (l *NopTransactionLogger) Close() error {
+	return nil
+}
+
+// LastSequence method returns the sequence assigned to the most recent event
+func (l *NopTransactionLogger) LastSequence() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSequence
+}
+
+// QueueDepth method returns 0, as nothing is queued
+func (l *NopTransactionLogger) QueueDepth() int {
+	return 0
+}
+
+// Ping method returns nil, as there is no storage to reach
+func (l *NopTransactionLogger) Ping() error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package transaction_logs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresDBConfig is a type containing information to configure the postgres db
+type PostgresDBConfig struct {
+	DSN              string        // Full connection string or URL, overriding the connection fields below
+	Host             string        // Hostname where the database is hosted
+	Port             int           // Port the database listens on, 0 for the default
+	DBName           string        // Name of the database
+	User             string        // DB user
+	Password         string        // DB password
+	SSLMode          string        // disable, require, verify-ca or verify-full
+	SSLRootCert      string        // Path of the CA certificate used to verify the server
+	MaxOpenConns     int           // Maximum number of open connections, 0 for unlimited
+	MaxIdleConns     int           // Maximum number of idle connections, 0 for the driver default
+	ConnMaxLifetime  time.Duration // Maximum time a connection is reused, 0 for unlimited
+	StatementTimeout time.Duration // Maximum time a statement may run, 0 for unlimited
+	Schema           string        // Schema containing the transactions table
+	Table            string        // Name of the transactions table
+	MaxRetries       int           // Consecutive failed writes before the circuit breaker opens
+	RetryBackoff     time.Duration // Delay before the first retry, doubled after each failure
+	MaxRetryBackoff  time.Duration // Maximum delay between retries
+	SpillLimit       int           // Maximum number of events buffered while writes fail, 0 for unlimited
+	SequenceBlock    int           // Number of sequences reserved from the database at a time
+}
+
+// DefaultPostgresDBConfig returns the configuration used by earlier versions of vile,
+// which expected a development database running alongside the docker container
+func DefaultPostgresDBConfig() PostgresDBConfig {
+	return PostgresDBConfig{
+		Host:            "host.docker.internal",
+		DBName:          "vile",
+		User:            "test",
+		Password:        "password",
+		SSLMode:         "disable",
+		Schema:          "public",
+		Table:           "transactions",
+		MaxRetries:      5,
+		RetryBackoff:    100 * time.Millisecond,
+		MaxRetryBackoff: 30 * time.Second,
+		SpillLimit:      100000,
+		SequenceBlock:   1000,
+	}
+}
+
+// PostgresConfigFromEnv returns the default configuration overridden by the
+// VILE_PG_* environment variables, returning an error if any are invalid
+func PostgresConfigFromEnv() (PostgresDBConfig, error) {
+	c := DefaultPostgresDBConfig()
+	strs := map[string]*string{
+		"VILE_PG_DSN":         &c.DSN,
+		"VILE_PG_HOST":        &c.Host,
+		"VILE_PG_DATABASE":    &c.DBName,
+		"VILE_PG_USER":        &c.User,
+		"VILE_PG_PASSWORD":    &c.Password,
+		"VILE_PG_SSLMODE":     &c.SSLMode,
+		"VILE_PG_SSLROOTCERT": &c.SSLRootCert,
+		"VILE_PG_SCHEMA":      &c.Schema,
+		"VILE_PG_TABLE":       &c.Table,
+	}
+	for name, field := range strs {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+	ints := map[string]*int{
+		"VILE_PG_PORT":           &c.Port,
+		"VILE_PG_MAX_OPEN_CONNS": &c.MaxOpenConns,
+		"VILE_PG_MAX_IDLE_CONNS": &c.MaxIdleConns,
+		"VILE_PG_MAX_RETRIES":    &c.MaxRetries,
+		"VILE_PG_SPILL_LIMIT":    &c.SpillLimit,
+		"VILE_PG_SEQUENCE_BLOCK": &c.SequenceBlock,
+	}
+	for name, field := range ints {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return c, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+			*field = n
+		}
+	}
+	durations := map[string]*time.Duration{
+		"VILE_PG_CONN_MAX_LIFETIME": &c.ConnMaxLifetime,
+		"VILE_PG_STATEMENT_TIMEOUT": &c.StatementTimeout,
+		"VILE_PG_RETRY_BACKOFF":     &c.RetryBackoff,
+		"VILE_PG_MAX_RETRY_BACKOFF": &c.MaxRetryBackoff,
+	}
+	for name, field := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return c, fmt.Errorf("%s must be a non-negative duration", name)
+			}
+			*field = d
+		}
+	}
+	return c, nil
+}
+
+// connString returns the connection string of the database in the key/value
+// format understood by lib/pq, converting DSN from a URL if necessary
+func (c PostgresDBConfig) connString() (string, error) {
+	if c.Schema == "" || c.Table == "" {
+		return "", fmt.Errorf("postgres schema and table names are required")
+	}
+	var params []string
+	if c.DSN != "" {
+		dsn := c.DSN
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			if dsn, err = pq.ParseURL(dsn); err != nil {
+				return "", fmt.Errorf("invalid postgres DSN: %w", err)
+			}
+		}
+		params = append(params, dsn)
+	} else {
+		fields := map[string]string{
+			"host":        c.Host,
+			"dbname":      c.DBName,
+			"user":        c.User,
+			"password":    c.Password,
+			"sslmode":     c.SSLMode,
+			"sslrootcert": c.SSLRootCert,
+		}
+		if c.Port != 0 {
+			fields["port"] = strconv.Itoa(c.Port)
+		}
+		keys := make([]string, 0, len(fields))
+		for k, v := range fields {
+			if v != "" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			params = append(params, k+"="+quoteConnValue(fields[k]))
+		}
+	}
+	// Unrecognized parameters are sent to the server as run-time settings
+	if c.StatementTimeout > 0 {
+		params = append(params, fmt.Sprintf("statement_timeout=%d", c.StatementTimeout.Milliseconds()))
+	}
+	return strings.Join(params, " "), nil
+}
+
+// qualifiedTable returns the quoted name of the transactions table
+func (c PostgresDBConfig) qualifiedTable() string {
+	return pq.QuoteIdentifier(c.Schema) + "." + pq.QuoteIdentifier(c.Table)
+}
+
+// quoteConnValue quotes a value of a key/value connection string
+func quoteConnValue(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+	return "'" + v + "'"
+}
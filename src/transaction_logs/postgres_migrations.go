@@ -0,0 +1,115 @@
+package transaction_logs
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var ErrSchemaTooNew = errors.New("postgres schema is newer than this version of vile")
+
+// migrationFiles are the ordered schema migrations of the Postgres backend, named
+// after the schema version they upgrade to. Migrations must never be edited once
+// released, any change to the schema is made by adding a new migration
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrations are the schema migrations of the transactions table
+var migrations, _ = fs.Sub(migrationFiles, "migrations")
+
+// migration type is a single embedded schema migration
+type migration struct {
+	version int    // Schema version after the migration is applied
+	name    string // Name of the migration file
+	sql     string // Statements of the migration, with {{table}} as the migrated table and {{schema}} as its schema
+}
+
+// loadMigrations returns the migrations in the root of files ordered by
+// version, returning an error if any version is missing or duplicated
+func loadMigrations(files fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(files, ".")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s is not named after its version", entry.Name())
+		}
+		data, err := fs.ReadFile(files, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: entry.Name(), sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence, expected version %d", m.name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// MigratePostgres upgrades the table to the latest schema version using the
+// migrations in the root of files, which are named after the version they upgrade
+// to. The version is recorded in a table alongside the migrated table, and every
+// pending migration is applied in a single transaction so a failed upgrade leaves
+// the schema unchanged. Tables created before versioning are upgraded in place
+func MigratePostgres(db *sql.DB, schema string, table string, files fs.FS) error {
+	migrations, err := loadMigrations(files)
+	if err != nil {
+		return err
+	}
+	latest := len(migrations)
+	qualified := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+	versionTable := pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table+"_schema_version")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statements := []string{
+		"CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(schema),
+		`CREATE TABLE IF NOT EXISTS ` + versionTable + ` (
+			version    INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		// Other instances starting at the same time wait for the upgrade to finish
+		"LOCK TABLE " + versionTable + " IN EXCLUSIVE MODE",
+	}
+	for _, stmt := range statements {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	var current int
+	if err = tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM " + versionTable).Scan(&current); err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("%w: %s schema version %d, latest known version %d", ErrSchemaTooNew, table, current, latest)
+	}
+	for _, m := range migrations[current:] {
+		slog.Info("Applying postgres schema migration", "table", table, "migration", m.name)
+		stmt := strings.NewReplacer("{{table}}", qualified, "{{schema}}", pq.QuoteIdentifier(schema)).Replace(m.sql)
+		if _, err = tx.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		if _, err = tx.Exec("INSERT INTO "+versionTable+" (version) VALUES ($1)", m.version); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
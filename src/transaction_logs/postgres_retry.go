@@ -0,0 +1,201 @@
+package transaction_logs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrCircuitOpen = errors.New("transaction log circuit breaker is open")
+var ErrSpillFull = errors.New("transaction log spill buffer is full")
+var ErrNoSequences = errors.New("no transaction log sequences are reserved")
+
+// circuitState type is the state of the Postgres logger's circuit breaker
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota // Events are written as they arrive
+	circuitOpen                       // Writes are failing, events are buffered and retried periodically
+)
+
+// String returns the name of the circuit state
+func (s circuitState) String() string {
+	if s == circuitOpen {
+		return "open"
+	}
+	return "closed"
+}
+
+// CircuitState method returns the state of the circuit breaker,
+// which is open while the database is rejecting writes
+func (l *PostgresTransactionLogger) CircuitState() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state.String()
+}
+
+// circuitErr returns an error describing the outage if the circuit breaker is open
+func (l *PostgresTransactionLogger) circuitErr() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state != circuitOpen {
+		return nil
+	}
+	return fmt.Errorf("%w for %s with %d events buffered: %v", ErrCircuitOpen,
+		time.Since(l.openedAt).Round(time.Second), len(l.pending), l.lastErr)
+}
+
+// enqueue encrypts the event and adds it to the pending events,
+// dropping it if the spill buffer is full
+func (l *PostgresTransactionLogger) enqueue(e Event, errs chan<- error) {
+	e, err := e.encrypt()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == nil && l.config.SpillLimit > 0 && len(l.pending) >= l.config.SpillLimit {
+		err = ErrSpillFull
+	}
+	if err != nil {
+		writeErrors.Inc()
+		report(errs, newEventError(e, err))
+		// Dropped events no longer need a sequence
+		if e.Sequence == 0 {
+			l.unsequenced--
+		}
+		l.wg.Done()
+		return
+	}
+	l.pending = append(l.pending, e)
+}
+
+// flush writes the pending events in order until they have all been written
+// or a write fails, returning how long to wait before flushing again
+func (l *PostgresTransactionLogger) flush(errs chan<- error) time.Duration {
+	for {
+		l.mu.Lock()
+		if len(l.pending) == 0 {
+			l.mu.Unlock()
+			return 0
+		}
+		if wait := time.Until(l.nextAttempt); wait > 0 {
+			l.mu.Unlock()
+			return wait
+		}
+		// Events queued without a sequence are given the next reserved one
+		if l.pending[0].Sequence == 0 {
+			sequence, ok := l.nextSequence()
+			if !ok {
+				l.failed(ErrNoSequences, errs)
+				l.mu.Unlock()
+				continue
+			}
+			l.pending[0].Sequence = sequence
+			l.unsequenced--
+		}
+		e := l.pending[0]
+		l.mu.Unlock()
+
+		span := e.startSpan("transaction_log.write")
+		start := time.Now()
+		sequence, err := l.insert(e)
+		writeDuration.Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+
+		l.mu.Lock()
+		if err != nil && isRetryable(err) {
+			l.failed(err, errs)
+			l.mu.Unlock()
+			continue
+		}
+		// Events the database rejects outright would fail forever if retried
+		if err != nil {
+			writeErrors.Inc()
+			report(errs, newEventError(e, err))
+		} else {
+			l.succeeded()
+			if sequence > l.applied {
+				l.applied = sequence
+			}
+		}
+		l.pending = l.pending[1:]
+		l.wg.Done()
+		l.mu.Unlock()
+	}
+}
+
+// failed records a failed write, backing off exponentially and opening the circuit
+// breaker after too many consecutive failures. The caller must hold the lock
+func (l *PostgresTransactionLogger) failed(err error, errs chan<- error) {
+	writeRetries.Inc()
+	l.failures++
+	l.lastErr = err
+	backoff := l.config.MaxRetryBackoff
+	if shift := l.failures - 1; shift < 32 && l.config.RetryBackoff<<shift < backoff {
+		backoff = l.config.RetryBackoff << shift
+	}
+	l.nextAttempt = time.Now().Add(backoff)
+	if l.state == circuitClosed && l.failures >= l.config.MaxRetries {
+		l.state, l.openedAt = circuitOpen, time.Now()
+		breakerOpen.Set(1)
+		writeErrors.Inc()
+		report(errs, fmt.Errorf("%w after %d failed writes: %w", ErrCircuitOpen, l.failures, err))
+		slog.Warn("Postgres transaction log is unreachable, buffering events", "error", err)
+	}
+}
+
+// succeeded records a successful write, closing the circuit
+// breaker if it was open. The caller must hold the lock
+func (l *PostgresTransactionLogger) succeeded() {
+	if l.state == circuitOpen {
+		slog.Info("Postgres transaction log recovered",
+			"outage", time.Since(l.openedAt).Round(time.Second), "buffered", len(l.pending)-1)
+		breakerOpen.Set(0)
+	}
+	l.state, l.failures, l.lastErr = circuitClosed, 0, nil
+	l.nextAttempt = time.Time{}
+}
+
+// drain makes a final attempt to write the pending events when the
+// logger is closed, discarding any that still cannot be written
+func (l *PostgresTransactionLogger) drain(errs chan<- error) {
+	l.mu.Lock()
+	l.nextAttempt = time.Time{}
+	l.mu.Unlock()
+	l.flush(errs)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) > 0 {
+		slog.Error("Discarding events that could not be written to postgres",
+			"count", len(l.pending), "error", l.lastErr)
+		for range l.pending {
+			l.wg.Done()
+		}
+		l.pending = nil
+	}
+}
+
+// report sends the error without blocking if nobody is reading errors
+func report(errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
+// isRetryable reports whether a failed write may succeed if retried, such as
+// when the connection was lost, rather than being rejected by the database
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		// Network and driver errors happen before the database sees the query
+		return true
+	}
+	switch pqErr.Code.Class() {
+	case "08", "40", "53", "57", "58":
+		// Connection, rollback, resource, operator intervention and system errors
+		return true
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package transaction_logs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPostgresConnString uses table-driven testing to test how the
+// Postgres configuration is converted to a connection string
+func TestPostgresConnString(t *testing.T) {
+	testCases := []struct {
+		name   string
+		env    map[string]string
+		exp    string
+		expErr bool
+	}{
+		{
+			name: "Defaults",
+			exp:  "dbname='vile' host='host.docker.internal' password='password' sslmode='disable' user='test'",
+		},
+		{
+			name: "Fields",
+			env: map[string]string{
+				"VILE_PG_HOST":              "db.internal",
+				"VILE_PG_PORT":              "6432",
+				"VILE_PG_PASSWORD":          "it's secret",
+				"VILE_PG_SSLMODE":           "verify-full",
+				"VILE_PG_SSLROOTCERT":       "/etc/ssl/ca.pem",
+				"VILE_PG_STATEMENT_TIMEOUT": "5s",
+			},
+			exp: `dbname='vile' host='db.internal' password='it\'s secret' port='6432' ` +
+				`sslmode='verify-full' sslrootcert='/etc/ssl/ca.pem' user='test' statement_timeout=5000`,
+		},
+		{
+			name: "URL",
+			env:  map[string]string{"VILE_PG_DSN": "postgres://bob:secret@db:5432/vile?sslmode=require"},
+			exp:  "dbname='vile' host='db' password='secret' port='5432' sslmode='require' user='bob'",
+		},
+		{
+			name:   "InvalidPool",
+			env:    map[string]string{"VILE_PG_MAX_OPEN_CONNS": "many"},
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			c, err := PostgresConfigFromEnv()
+			if tc.expErr {
+				if err == nil {
+					t.Fatal("expected an error, instead got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %q", err)
+			}
+			connStr, err := c.connString()
+			if err != nil {
+				t.Fatalf("unexpected error: %q", err)
+			}
+			if connStr != tc.exp {
+				t.Errorf("expected %q, instead got %q", tc.exp, connStr)
+			}
+		})
+	}
+}
+
+func TestPostgresTableName(t *testing.T) {
+	c := DefaultPostgresDBConfig()
+	c.Schema, c.Table = "vile", `odd"name`
+	if table := c.qualifiedTable(); table != `"vile"."odd""name"` {
+		t.Errorf("unexpected table name %q", table)
+	}
+	c.Table = ""
+	if _, err := c.connString(); err == nil || !strings.Contains(err.Error(), "table") {
+		t.Errorf("expected an error for a missing table name, instead got %v", err)
+	}
+}
+
+// TestPostgresRetry simulates a database outage by failing writes
+// until the database is brought back
+func TestPostgresRetry(t *testing.T) {
+	c := DefaultPostgresDBConfig()
+	c.MaxRetries, c.RetryBackoff, c.MaxRetryBackoff, c.SpillLimit = 2, time.Millisecond, 5*time.Millisecond, 3
+	var mu sync.Mutex
+	down := true
+	written := []string{}
+	l := &PostgresTransactionLogger{config: c}
+	l.insert = func(e Event) (uint64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			return 0, errors.New("connection refused")
+		}
+		written = append(written, e.Key)
+		return e.Sequence, nil
+	}
+	l.reserved = []uint64{1, 2, 3, 4}
+	next := uint64(5)
+	l.reserve = func(n int) ([]uint64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		next += uint64(n)
+		return []uint64{next - uint64(n)}, nil
+	}
+	l.Run()
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		l.WritePut(key, "val")
+	}
+	// The circuit breaker should open without blocking writes
+	deadline := time.Now().Add(time.Second)
+	for l.CircuitState() != "open" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := l.circuitErr(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected %q, instead got %v", ErrCircuitOpen, err)
+	}
+	// Events beyond the spill limit should be dropped and reported
+	var dropped bool
+	for len(l.Err()) > 0 {
+		if err := <-l.Err(); errors.Is(err, ErrSpillFull) {
+			dropped = true
+		}
+	}
+	if !dropped {
+		t.Error("expected an event to be dropped when the spill buffer was full")
+	}
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	l.Wait()
+	if l.CircuitState() != "closed" {
+		t.Errorf("expected the circuit breaker to close once writes succeed")
+	}
+	if strings.Join(written, ",") != "key1,key2,key3" {
+		t.Errorf("expected buffered events to be written in order, instead got %v", written)
+	}
+	// The dropped event's sequence is never applied
+	if l.LastSequence() != 4 || l.AppliedSequence() != 3 {
+		t.Errorf("expected sequences 4 and 3, instead got %d and %d", l.LastSequence(), l.AppliedSequence())
+	}
+}
+
+// TestPostgresSequences checks that events are given reserved sequences in
+// order, and that queueing doesn't wait for the database once they run out
+func TestPostgresSequences(t *testing.T) {
+	c := DefaultPostgresDBConfig()
+	c.RetryBackoff, c.SequenceBlock = time.Millisecond, 2
+	var mu sync.Mutex
+	release := make(chan struct{})
+	failed := false
+	next := uint64(20)
+	var written []uint64
+	l := &PostgresTransactionLogger{config: c, reserved: []uint64{10, 11}}
+	l.insert = func(e Event) (uint64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, e.Sequence)
+		return e.Sequence, nil
+	}
+	l.reserve = func(n int) ([]uint64, error) {
+		// The database is unreachable until released
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		if n != 2 {
+			t.Errorf("expected blocks of 2 sequences to be reserved, instead got %d", n)
+		}
+		if !failed {
+			failed = true
+			return nil, errors.New("connection refused")
+		}
+		next += 10
+		return []uint64{next - 10, next - 9}, nil
+	}
+	l.Run()
+	var sequences []uint64
+	for _, key := range []string{"key1", "key2", "key3", "key4"} {
+		sequences = append(sequences, l.WriteEvent(Event{EventType: EventPut, Key: key, Value: "val"}))
+	}
+	// Events queued once the reserved sequences are used up get theirs when written
+	if fmt.Sprint(sequences) != "[10 11 0 0]" {
+		t.Errorf("expected sequences [10 11 0 0], instead got %v", sequences)
+	}
+	close(release)
+	l.Wait()
+	if fmt.Sprint(written) != "[10 11 20 21]" {
+		t.Errorf("expected sequences [10 11 20 21] to be written, instead got %v", written)
+	}
+	if l.LastSequence() != 21 || l.AppliedSequence() != 21 {
+		t.Errorf("expected sequences 21 and 21, instead got %d and %d", l.LastSequence(), l.AppliedSequence())
+	}
+	// Later events are given reserved sequences again once a block is reserved
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		l.mu.Lock()
+		reserved := len(l.reserved)
+		l.mu.Unlock()
+		if reserved > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if seq := l.WriteEvent(Event{EventType: EventPut, Key: "key5", Value: "val"}); seq != 30 {
+		t.Errorf("expected sequence 30, instead got %d", seq)
+	}
+	l.Wait()
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	loaded, err := loadMigrations(migrations)
+	if err != nil {
+		t.Fatalf("unexpected error while loading migrations: %q", err)
+	}
+	if len(loaded) < 2 {
+		t.Fatalf("expected at least 2 migrations, instead got %d", len(loaded))
+	}
+	for i, m := range loaded {
+		if m.version != i+1 {
+			t.Errorf("expected migration %s to have version %d", m.name, i+1)
+		}
+		if !strings.Contains(m.sql, "{{table}}") {
+			t.Errorf("expected migration %s to refer to the configured table", m.name)
+		}
+	}
+}
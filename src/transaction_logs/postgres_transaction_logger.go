@@ -4,8 +4,9 @@ import (
 	"database/sql"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -13,90 +14,224 @@ import (
 // PostgresTransactionLogger is a struct the satisfies the TransactionLogger
 // interface, and writes logs to a Postgres database
 type PostgresTransactionLogger struct {
-	events chan<- Event   // Write-only channel for sending events
-	errors <-chan error   // Read-only channel for receiving errors
-	db     *sql.DB        // Database access interface
-	wg     sync.WaitGroup // Wait-group for concurrency
-}
+	events chan<- Event                // Write-only channel for sending events
+	errors <-chan error                // Read-only channel for receiving errors
+	db     *sql.DB                     // Database access interface
+	config PostgresDBConfig            // Configuration the logger was created with
+	table  string                      // Quoted name of the transactions table
+	wg     sync.WaitGroup              // Wait-group for concurrency
+	insert func(Event) (uint64, error) // Writes a single event to the db, returning its sequence
+	done   chan struct{}               // Closed once Run's goroutine has stopped
+
+	// reserve takes the next n sequences from the db, which are never given to another node
+	reserve func(n int) ([]uint64, error)
+
+	seqMu sync.Mutex // Held while an event is assigned a sequence and queued, so events are queued in order
 
-// PostgresDBConfig is a type containing information to configure the postgres db
-type PostgresDBConfig struct {
-	dbName   string // Name of the database
-	host     string // Hostname where the database is hosted
-	user     string // DB user
-	password string // DB password
+	mu           sync.Mutex   // Guards the fields below
+	lastSequence uint64       // Sequence assigned to the most recent event
+	reserved     []uint64     // Sequences reserved from the db that are yet to be assigned, in order
+	reserving    bool         // Whether another block of sequences is being reserved
+	unsequenced  int          // Number of queued events waiting for a sequence to be reserved
+	applied      uint64       // Highest sequence written to the db
+	pending      []Event      // Events waiting to be written, in order
+	state        circuitState // State of the circuit breaker
+	failures     int          // Consecutive failed writes
+	lastErr      error        // Error of the most recent failed write
+	openedAt     time.Time    // Time the circuit breaker opened
+	nextAttempt  time.Time    // Time the next write may be attempted
 }
 
 // NewPostgresTransactionLogger is a constructor for the PostgresTransactionLogger type,
 // It takes PostgresDBConfig object containing db configuration information
 // It returns a TransactionLogger interface or any errors if they occur
 func NewPostgresTransactionLogger(c PostgresDBConfig) (TransactionLogger, error) {
-	connStr := fmt.Sprintf("host=%s dbname=%s user=%s password=%s sslmode=disable",
-		c.host, c.dbName, c.user, c.password,
-	)
+	db, err := OpenPostgres(c)
+	if err != nil {
+		return nil, err
+	}
+	logger := &PostgresTransactionLogger{db: db, config: c, table: c.qualifiedTable()}
+	logger.insert = logger.insertEvent
+	logger.reserve = logger.reserveSequences
+	// Create or upgrade the transactions table
+	if err = MigratePostgres(db, c.Schema, c.Table, migrations); err != nil {
+		return nil, fmt.Errorf("error while migrating schema: %w", err)
+	}
+	// New events continue from the last sequence in the table
+	err = db.QueryRow("SELECT COALESCE(MAX(sequence), 0) FROM " + logger.table).Scan(&logger.lastSequence)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading last sequence: %w", err)
+	}
+	logger.applied = logger.lastSequence
+	if logger.reserved, err = logger.reserve(c.SequenceBlock); err != nil {
+		return nil, fmt.Errorf("error while reserving sequences: %w", err)
+	}
+	return logger, nil
+}
+
+// OpenPostgres opens a pool of connections to the configured database,
+// returning an error if the database cannot be reached
+func OpenPostgres(c PostgresDBConfig) (*sql.DB, error) {
+	connStr, err := c.connString()
+	if err != nil {
+		return nil, err
+	}
 	// Open connection to database
-	log.Println("Attempting to open connection to postgres database...")
+	slog.Info("Attempting to open connection to postgres database...")
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, fmt.Errorf("error while opening database: %q", err)
 	}
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
 	// Test database connection
 	err = db.Ping()
 	if err != nil && err != io.EOF {
+		db.Close()
 		return nil, fmt.Errorf("error while testing database connection: %q", err)
 	}
-	log.Println("Successfully connected to postgres database")
-	logger := &PostgresTransactionLogger{db: db}
-	// Check that the table exists
-	exists, err := logger.verifyTableExists()
-	if err != nil {
-		return nil, fmt.Errorf("error while verifying table exists: %q", err)
-	}
-	if !exists {
-		if err = logger.createTable(); err != nil {
-			return nil, fmt.Errorf("error while creating table: %q", err)
-		}
-	}
-	return logger, nil
+	slog.Info("Successfully connected to postgres database")
+	return db, nil
 }
 
-// Run method initializes channels, listens for inputs and logs events to db
+// Run method initializes channels, listens for inputs and logs events to db. Failed
+// writes are retried with exponential backoff, buffering later events locally so
+// that handlers aren't blocked while the database is unreachable
 func (l *PostgresTransactionLogger) Run() {
 	// Initialize events channel
 	events := make(chan Event, 16)
 	l.events = events
-	// Initialize error channel
-	errs := make(chan error, 1)
+	// Initialize error channel, errors are dropped rather than
+	// blocking writes if nobody is reading them
+	errs := make(chan error, 16)
 	l.errors = errs
+	done := make(chan struct{})
+	l.done = done
 	// Run a goroutine to constantly handle new events coming over channels
 	go func() {
-		query := `INSERT INTO transactions
-			(event_type, key, value)
-			VALUES ($1, $2, $3)`
-		for e := range events {
-			_, err := l.db.Exec(
-				query,
-				e.EventType, e.Key, e.Value,
-			)
-			if err != nil {
-				errs <- err
+		defer close(done)
+		var retry <-chan time.Time
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					l.drain(errs)
+					return
+				}
+				l.enqueue(e, errs)
+			case <-retry:
+				retry = nil
+			}
+			if wait := l.flush(errs); wait > 0 && retry == nil {
+				retry = time.After(wait)
 			}
 		}
 	}()
 }
 
+// reserveSequences takes the next n values of the sequence column's database
+// sequence, so that every node sharing the table assigns different sequences
+func (l *PostgresTransactionLogger) reserveSequences(n int) ([]uint64, error) {
+	rows, err := l.db.Query(
+		"SELECT nextval(pg_get_serial_sequence($1, 'sequence')) FROM generate_series(1, $2)",
+		l.table, max(n, 1),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reserve sequences: %w", err)
+	}
+	defer rows.Close()
+	var sequences []uint64
+	for rows.Next() {
+		var sequence uint64
+		if err := rows.Scan(&sequence); err != nil {
+			return nil, fmt.Errorf("cannot reserve sequences: %w", err)
+		}
+		sequences = append(sequences, sequence)
+	}
+	return sequences, rows.Err()
+}
+
+// nextSequence returns the next reserved sequence, and false if none are left.
+// Another block is reserved in the background once half of the reserved
+// sequences have been assigned. The caller must hold mu
+func (l *PostgresTransactionLogger) nextSequence() (uint64, bool) {
+	if len(l.reserved) <= l.config.SequenceBlock/2 {
+		l.refill()
+	}
+	if len(l.reserved) == 0 {
+		return 0, false
+	}
+	sequence := l.reserved[0]
+	l.reserved = l.reserved[1:]
+	l.lastSequence = max(l.lastSequence, sequence)
+	return sequence, true
+}
+
+// refill reserves another block of sequences unless one is being reserved
+// already, retrying with backoff while the db is unreachable. The caller must hold mu
+func (l *PostgresTransactionLogger) refill() {
+	if l.reserving {
+		return
+	}
+	l.reserving = true
+	go func() {
+		for attempt := 0; ; attempt++ {
+			sequences, err := l.reserve(l.config.SequenceBlock)
+			if err == nil && len(sequences) > 0 {
+				l.mu.Lock()
+				defer l.mu.Unlock()
+				l.reserved = append(l.reserved, sequences...)
+				l.reserving = false
+				return
+			}
+			backoff := l.config.MaxRetryBackoff
+			if attempt < 32 && l.config.RetryBackoff<<attempt < backoff {
+				backoff = l.config.RetryBackoff << attempt
+			}
+			slog.Warn("Could not reserve transaction log sequences", "error", err, "retry_in", backoff)
+			time.Sleep(backoff)
+		}
+	}()
+}
+
+// insertEvent writes a single encrypted event to the db, returning the sequence
+// it was stored with. Sequences are reserved from the db so that they are
+// unique across nodes, and are assigned before events are written
+func (l *PostgresTransactionLogger) insertEvent(e Event) (uint64, error) {
+	query := `INSERT INTO ` + l.table + `
+		(sequence, event_type, namespace, key, field, value, value_type, key_id, event_time, node_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING sequence`
+	var sequence uint64
+	err := l.db.QueryRow(
+		query,
+		e.Sequence, e.EventType, e.Namespace, e.Key, e.Field, e.Value, e.ValueType, e.KeyID, e.Timestamp, e.NodeID,
+	).Scan(&sequence)
+	return sequence, err
+}
+
 // ReadEvents method parses an existing postgres db and loads prior events into
 // store
 func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	return l.ReadEventsAfter(0)
+}
+
+// ReadEventsAfter method reads the events with a sequence greater than the
+// provided sequence, it can be used while the logger is running
+func (l *PostgresTransactionLogger) ReadEventsAfter(sequence uint64) (<-chan Event, <-chan error) {
 	outEvent := make(chan Event)    // Unbuffered event channel to stream concurrent events
 	outError := make(chan error, 1) // Buffered error channel to stream concurrent errors
 	go func() {
 		// Close the channels when the goroutine ends
 		defer close(outEvent)
 		defer close(outError)
-		query := `SELECT sequence, event_type, key, value FROM transactions
+		query := `SELECT sequence, event_type, namespace, key, field, value, value_type, key_id, event_time, node_id
+				FROM ` + l.table + ` WHERE sequence > $1
 				ORDER BY sequence`
-		rows, err := l.db.Query(query)
+		rows, err := l.db.Query(query, sequence)
 		if err != nil {
 			outError <- fmt.Errorf("error while running sql query: %q", err)
 			return
@@ -104,16 +239,29 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 		defer rows.Close()
 		e := Event{}
 		for rows.Next() {
+			// Events logged by earlier versions have no timestamp
+			var timestamp sql.NullTime
 			err = rows.Scan(
 				&e.Sequence,
 				&e.EventType,
+				&e.Namespace,
 				&e.Key,
+				&e.Field,
 				&e.Value,
+				&e.ValueType,
+				&e.KeyID,
+				&timestamp,
+				&e.NodeID,
 			)
+			e.Timestamp = timestamp.Time
 			if err != nil {
 				outError <- fmt.Errorf("error while reading row: %q", err)
 				return
 			}
+			if e, err = e.decrypt(); err != nil {
+				outError <- err
+				return
+			}
 			outEvent <- e
 		}
 		err = rows.Err()
@@ -126,12 +274,36 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 
 // WritePut method logs PUT events for the provided key:value pair to the postgres db
 func (l *PostgresTransactionLogger) WritePut(key, value string) {
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
+	l.WriteEvent(Event{EventType: EventPut, Key: key, Value: value})
 }
 
 // WriteDelete method logs DELETE events for the provided key to the postgres db
 func (l *PostgresTransactionLogger) WriteDelete(key string) {
-	l.events <- Event{EventType: EventDelete, Key: key}
+	l.WriteEvent(Event{EventType: EventDelete, Key: key})
+}
+
+// WriteEvent method logs the provided event to the postgres db, returning the
+// sequence assigned to the event. It never waits on the db: if every reserved
+// sequence has been used, the event is given one once it is written and 0 is
+// returned, as are the events queued after it, so that sequences stay in order
+func (l *PostgresTransactionLogger) WriteEvent(e Event) uint64 {
+	// Trace the time spent waiting for space in the events channel
+	span := e.startSpan("transaction_log.enqueue")
+	defer span.End()
+	l.wg.Add(1)
+	// Sequences are assigned while queueing so events are written in order
+	l.seqMu.Lock()
+	defer l.seqMu.Unlock()
+	l.mu.Lock()
+	if l.unsequenced == 0 {
+		e.Sequence, _ = l.nextSequence()
+	}
+	if e.Sequence == 0 {
+		l.unsequenced++
+	}
+	l.mu.Unlock()
+	l.events <- e.stamp()
+	return e.Sequence
 }
 
 // Err method returns any errors that have been read from the logger's error channel
@@ -144,55 +316,46 @@ func (l *PostgresTransactionLogger) Wait() {
 	l.wg.Wait()
 }
 
-// Close method gracefully closes transactionlogger
+// Close method gracefully closes transactionlogger, making a final attempt
+// to write any buffered events before discarding them
 func (l *PostgresTransactionLogger) Close() error {
-	l.wg.Wait()
-
 	if l.events != nil {
 		close(l.events)
+		<-l.done
 	}
 
 	return l.db.Close()
 }
 
-// verifyTableExists
-func (l *PostgresTransactionLogger) verifyTableExists() (bool, error) {
-	const table = "transactions"
-
-	var result string
-
-	rows, err := l.db.Query(fmt.Sprintf("SELECT to_regclass('public.%s');", table))
-
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-	for rows.Next() && result != table {
-		rows.Scan(&result)
-	}
-
-	return result == table, rows.Err()
-}
-
-// createTable method
-func (l *PostgresTransactionLogger) createTable() error {
-	var err error
-
-	createQuery := `CREATE TABLE transactions (
-		sequence      BIGSERIAL PRIMARY KEY,
-		event_type    SMALLINT,
-		key 		  TEXT,
-		value         TEXT
-	  );`
-
-	_, err = l.db.Exec(createQuery)
-	if err != nil {
+// Ping method checks that the database is reachable, returning ErrCircuitOpen
+// while writes are failing even if the database responds to pings
+func (l *PostgresTransactionLogger) Ping() error {
+	if err := l.circuitErr(); err != nil {
 		return err
 	}
+	return l.db.Ping()
+}
 
-	return nil
+// QueueDepth method returns the number of events waiting to be written,
+// including those buffered while the database is unreachable
+func (l *PostgresTransactionLogger) QueueDepth() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.events) + len(l.pending)
 }
 
+// LastSequence method returns the sequence assigned to the most recent event,
+// which may not have been written to the db yet
 func (l *PostgresTransactionLogger) LastSequence() uint64 {
-	return 0
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSequence
+}
+
+// AppliedSequence method returns the highest sequence written to the db, events
+// up to it can be read back, e.g. to resume replication or watches
+func (l *PostgresTransactionLogger) AppliedSequence() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.applied
 }
@@ -0,0 +1,185 @@
+package transaction_logs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"rohitsingh/vile/core"
+)
+
+// writers is held for reading by writes to the store and for writing while a
+// recovery or restore is applied, so that the store can't change between being
+// compared with the recovered state and being made to match it
+var writers sync.RWMutex
+
+// BeginWrite blocks while a recovery or restore is being applied, and otherwise
+// holds it off until the returned function is called once the write is done
+func BeginWrite() (done func()) {
+	writers.RLock()
+	return writers.RUnlock
+}
+
+// RecoveryPoint type identifies the point in the transaction log to recover
+// the store to, events after either limit are not recovered. Zero valued
+// fields are not used as limits
+type RecoveryPoint struct {
+	Sequence uint64    // Last sequence to recover
+	Time     time.Time // Latest event time to recover
+}
+
+// RecoveryResult type summarizes the changes made to recover the store
+type RecoveryResult struct {
+	Sequence uint64 `json:"sequence"` // Sequence of the last event recovered
+	Puts     int    `json:"puts"`     // Number of keys restored to an earlier value
+	Deletes  int    `json:"deletes"`  // Number of keys removed
+}
+
+// includes reports whether the event happened at or before the recovery point,
+// events logged by earlier versions without a timestamp are always included
+func (p RecoveryPoint) includes(e Event) bool {
+	if p.Sequence > 0 && e.Sequence > p.Sequence {
+		return false
+	}
+	if !p.Time.IsZero() && !e.Timestamp.IsZero() && e.Timestamp.After(p.Time) {
+		return false
+	}
+	return true
+}
+
+// Recover restores every namespace to its state as of the recovery point by
+// replaying the transaction log up to that point. Rather than truncating the
+// log, the differences from the current state are written as new events, so
+// the recovery survives restarts and can itself be undone
+func Recover(tl TransactionLogger, point RecoveryPoint) (RecoveryResult, error) {
+	var result RecoveryResult
+	if point.Sequence == 0 && point.Time.IsZero() {
+		return result, errors.New("a recovery sequence or time is required")
+	}
+	if _, ok := tl.(*NopTransactionLogger); ok {
+		return result, fmt.Errorf("%w: there is no history to recover from", ErrNoTransactionLog)
+	}
+	// Rebuild the state of each namespace as of the recovery point
+	target := map[string]map[string]Event{}
+	events, errs := tl.ReadEventsAfter(0)
+	for e := range events {
+		if !point.includes(e) {
+			// Drain the remaining events so the reader can finish
+			continue
+		}
+		name := e.Namespace
+		if name == "" {
+			name = core.DefaultNamespace
+		}
+		if target[name] == nil {
+			target[name] = map[string]Event{}
+		}
+		switch e.EventType {
+		case EventPut:
+			target[name][e.Key] = e
+		case EventDelete:
+			delete(target[name], e.Key)
+		default:
+			recoverOperation(target[name], e)
+		}
+		result.Sequence = e.Sequence
+	}
+	if err := <-errs; err != nil {
+		return result, fmt.Errorf("cannot read transaction log: %w", err)
+	}
+	err := apply(tl, target, &result)
+	return result, err
+}
+
+// recoverOperation applies the typed operation of the event, if it is one, to
+// the key in the recovered state, recording the result as a put event. As when
+// replaying, operations that can't be applied are skipped
+func recoverOperation(keys map[string]Event, e Event) {
+	operation, ok := e.Operation()
+	if !ok {
+		return
+	}
+	old, exists := keys[e.Key]
+	next, err := operation(core.Entry{Value: old.Value, Type: old.ValueType}, exists)
+	if err != nil {
+		slog.Warn("Skipping transaction log operation that cannot be recovered",
+			"sequence", e.Sequence, "namespace", e.Namespace, "error", err)
+		return
+	}
+	e.EventType, e.Value, e.ValueType = EventPut, next.Value, next.Type
+	keys[e.Key] = e
+}
+
+// apply makes every namespace match the target state, which maps namespaces to
+// the put events of their keys, writing the differences as new events. Values
+// keep the modification time of their target event, if it has one, while the
+// new events record when they were written. Writers are blocked until it is done
+func apply(tl TransactionLogger, target map[string]map[string]Event, result *RecoveryResult) error {
+	writers.Lock()
+	defer writers.Unlock()
+	for _, name := range namespaceNames(target) {
+		store, err := core.Namespace(name)
+		if errors.Is(err, core.ErrNoSuchNamespace) {
+			store, err = core.CreateNamespace(name, core.NamespaceOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		current, err := store.Entries()
+		if err != nil {
+			return err
+		}
+		for key, e := range target[name] {
+			if entry, ok := current[key]; ok && entry.Value == e.Value && entry.Type == e.ValueType {
+				continue
+			}
+			commit := func() uint64 {
+				return tl.WriteEvent(Event{
+					EventType: EventPut,
+					Namespace: name,
+					Key:       key,
+					Value:     e.Value,
+					ValueType: e.ValueType,
+					Timestamp: now,
+				})
+			}
+			modified := e.Timestamp
+			if modified.IsZero() {
+				modified = now
+			}
+			entry := core.Entry{Value: e.Value, Type: e.ValueType, Modified: modified}
+			if err := store.Load(key, entry, commit); err != nil {
+				return err
+			}
+			result.Puts++
+		}
+		for key := range current {
+			if _, ok := target[name][key]; ok {
+				continue
+			}
+			commit := func() uint64 {
+				return tl.WriteEvent(Event{EventType: EventDelete, Namespace: name, Key: key, Timestamp: now})
+			}
+			if err := store.LoadDelete(key, now, commit); err != nil {
+				return err
+			}
+			result.Deletes++
+		}
+	}
+	return nil
+}
+
+// namespaceNames returns the names of every existing namespace
+// and every namespace in the recovered state
+func namespaceNames(target map[string]map[string]Event) []string {
+	names := core.Namespaces()
+	for name := range target {
+		if _, err := core.Namespace(name); errors.Is(err, core.ErrNoSuchNamespace) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,312 @@
+package transaction_logs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rohitsingh/vile/core"
+)
+
+// replayChunkSize is the number of bytes of the log file read at a time during replay
+var replayChunkSize = 1 << 20
+
+// replayProgressInterval is how often the progress of a replay is logged
+var replayProgressInterval = 2 * time.Second
+
+// replayer type folds replayed events into the final versions of each key, so
+// that the stores are loaded once rather than locked for every event
+type replayer struct {
+	checkpoint uint64                               // Events up to the checkpoint are already persisted
+	retention  int                                  // Maximum number of versions kept for each key
+	state      map[string]map[string][]core.Version // Versions of each key by namespace, oldest first
+	start      time.Time                            // Time the replay started
+	total      atomic.Int64                         // Size of the log in bytes, 0 if unknown
+	events     atomic.Int64                         // Number of events read
+	bytes      atomic.Int64                         // Number of bytes read, if the size is known
+}
+
+// newReplayer creates a replayer of the events after the checkpoint
+func newReplayer(checkpoint uint64) *replayer {
+	return &replayer{
+		checkpoint: checkpoint,
+		// Only the latest version is needed if history is disabled
+		retention: max(core.HistoryRetention(), 1),
+		state:     map[string]map[string][]core.Version{},
+		start:     time.Now(),
+	}
+}
+
+// add folds the event into the versions of its key, discarding the oldest
+// versions beyond the history retention. Typed operations are applied to the
+// key's latest folded version, or to its entry in the store if it has none.
+// Operations that can't be applied, e.g. as the key was evicted without the
+// eviction being logged, are skipped rather than failing the replay
+func (r *replayer) add(e Event) error {
+	if e.Sequence <= r.checkpoint {
+		return nil
+	}
+	operation, isOperation := e.Operation()
+	if e.EventType != EventPut && e.EventType != EventDelete && !isOperation {
+		return nil
+	}
+	name := e.Namespace
+	if name == "" {
+		name = core.DefaultNamespace
+	}
+	keys := r.state[name]
+	if keys == nil {
+		keys = map[string][]core.Version{}
+		r.state[name] = keys
+	}
+	versions := keys[e.Key]
+	v := core.Version{
+		Entry:   core.Entry{Value: e.Value, Type: e.ValueType, Modified: e.Timestamp, Sequence: e.Sequence},
+		Deleted: e.EventType == EventDelete,
+	}
+	if isOperation {
+		store, err := replayStore(name)
+		if err != nil {
+			return err
+		}
+		// Evictions from the namespace must be logged from now on
+		store.NoteOperation()
+		old, exists, err := r.latest(store, e.Key, versions)
+		if err != nil {
+			return err
+		}
+		next, err := operation(old, exists)
+		if err != nil {
+			slog.Warn("Skipping transaction log operation that cannot be replayed",
+				"sequence", e.Sequence, "namespace", name, "error", err)
+			return nil
+		}
+		v.Value, v.Type = next.Value, next.Type
+	}
+	if len(versions) == r.retention {
+		copy(versions, versions[1:])
+		versions[len(versions)-1] = v
+	} else {
+		versions = append(versions, v)
+	}
+	keys[e.Key] = versions
+	return nil
+}
+
+// latest returns the entry of the key as of the events folded so far,
+// and whether it exists
+func (r *replayer) latest(store *core.Store, key string, versions []core.Version) (core.Entry, bool, error) {
+	if len(versions) > 0 {
+		v := versions[len(versions)-1]
+		return v.Entry, !v.Deleted, nil
+	}
+	// Keys written before the checkpoint are held by the store's engine
+	entry, err := store.GetEntry(key)
+	if errors.Is(err, core.ErrNoSuchKey) {
+		return core.Entry{}, false, nil
+	}
+	return entry, err == nil, err
+}
+
+// read folds every event received from the channels of a logger
+func (r *replayer) read(events <-chan Event, errs <-chan error) error {
+	var err error
+	e, ok := Event{}, true
+	for ok && err == nil {
+		select {
+		case err, ok = <-errs:
+		case e, ok = <-events:
+			if ok {
+				r.events.Add(1)
+				r.add(e)
+			}
+		}
+	}
+	return err
+}
+
+// apply loads the folded versions into the store of each namespace
+func (r *replayer) apply() error {
+	for name, keys := range r.state {
+		store, err := replayStore(name)
+		if err != nil {
+			return err
+		}
+		if err := store.LoadVersions(keys); err != nil {
+			return fmt.Errorf("cannot load namespace %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// report logs the progress of the replay periodically until
+// the returned function is called, which logs a summary
+func (r *replayer) report() func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(replayProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				slog.Info("Replaying transaction log", r.progress()...)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+		slog.Info("Replayed transaction log", r.progress()...)
+	}
+}
+
+// progress returns the attributes describing the progress of the replay,
+// the percentage is only included if the size of the log is known
+func (r *replayer) progress() []any {
+	elapsed := time.Since(r.start)
+	events := r.events.Load()
+	attrs := []any{
+		"events", events,
+		"events_per_sec", int64(float64(events) / max(elapsed.Seconds(), 0.001)),
+		"elapsed", elapsed.Round(time.Millisecond).String(),
+	}
+	if total := r.total.Load(); total > 0 {
+		attrs = append(attrs, "percent", 100*r.bytes.Load()/total)
+	}
+	return attrs
+}
+
+// replayStore returns the store of the namespace an event was recorded in,
+// creating the namespace if it is no longer configured
+func replayStore(name string) (*core.Store, error) {
+	store, err := core.Namespace(name)
+	if errors.Is(err, core.ErrNoSuchNamespace) {
+		// Keep data belonging to namespaces that are no longer configured
+		slog.Warn("Restoring unconfigured namespace from transaction log", "namespace", name)
+		store, err = core.CreateNamespace(name, core.NamespaceOptions{})
+	}
+	return store, err
+}
+
+// replayChunk type is a run of complete lines of the log file,
+// which are parsed concurrently with the other chunks
+type replayChunk struct {
+	data   []byte
+	events []Event
+	err    error
+	parsed chan struct{} // Closed once events and err are set
+}
+
+// replay method reads the log file in large chunks, which are parsed and decrypted
+// in parallel and then folded into the replayer in order, recording the last sequence
+func (l *FileTransactionLogger) replay(r *replayer) error {
+	if info, err := l.file.Stat(); err == nil {
+		r.total.Store(info.Size())
+	}
+	done := make(chan struct{})
+	defer close(done)
+	workers := runtime.GOMAXPROCS(0)
+	jobs := make(chan *replayChunk)
+	order := make(chan *replayChunk, 2*workers) // Chunks in the order they were read
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		var rest []byte // Incomplete line at the end of the previous chunk
+		for {
+			buf := make([]byte, len(rest)+replayChunkSize)
+			copy(buf, rest)
+			n, err := io.ReadFull(l.file, buf[len(rest):])
+			buf = buf[:len(rest)+n]
+			eof := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+			if err != nil && !eof {
+				readErr <- fmt.Errorf("transaction log read failure: %w", err)
+				return
+			}
+			// Lines spanning chunks are carried over to the next chunk
+			end := len(buf)
+			if !eof {
+				end = bytes.LastIndexByte(buf, '\n') + 1
+			}
+			rest = buf[end:]
+			if end > 0 {
+				c := &replayChunk{data: buf[:end], parsed: make(chan struct{})}
+				select {
+				case order <- c:
+				case <-done:
+					return
+				}
+				select {
+				case jobs <- c:
+				case <-done:
+					return
+				}
+			}
+			if eof {
+				return
+			}
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for c := range jobs {
+				c.events, c.err = parseChunk(c.data)
+				close(c.parsed)
+			}
+		}()
+	}
+	for c := range order {
+		<-c.parsed
+		if c.err != nil {
+			return c.err
+		}
+		for _, e := range c.events {
+			if l.lastSequence >= e.Sequence {
+				return fmt.Errorf("transaction numbers out of sequence")
+			}
+			l.lastSequence = e.Sequence
+			if err := r.add(e); err != nil {
+				return err
+			}
+		}
+		r.events.Add(int64(len(c.events)))
+		r.bytes.Add(int64(len(c.data)))
+	}
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// parseChunk parses and decrypts each line of a chunk of the log file
+func parseChunk(data []byte) ([]Event, error) {
+	lines := bytes.Split(data, []byte{'\n'})
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	events := make([]Event, 0, len(lines))
+	for _, line := range lines {
+		e, err := parseEvent(string(bytes.TrimSuffix(line, []byte{'\r'})))
+		if err == nil {
+			e, err = e.decrypt()
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
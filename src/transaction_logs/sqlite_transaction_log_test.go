@@ -0,0 +1,73 @@
+package transaction_logs
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rohitsingh/vile/core"
+)
+
+func TestSQLiteLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vile.db")
+	l, err := NewSQLiteTransactionLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+	modified := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	l.WriteEvent(Event{EventType: EventPut, Key: "a", Value: "1", Timestamp: modified})
+	l.WriteEvent(Event{EventType: EventPut, Namespace: "other", Key: "b", Value: `["2"]`, ValueType: core.TypeList})
+	if seq := l.WriteEvent(Event{EventType: EventDelete, Key: "a"}); seq != 3 {
+		t.Errorf("expected sequence 3, instead got %d", seq)
+	}
+	if seq := l.WriteEvent(Event{EventType: EventHashDelete, Key: "c", Field: "f"}); seq != 4 {
+		t.Errorf("expected sequence 4, instead got %d", seq)
+	}
+	l.Wait()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Sequences should continue from the events already in the database
+	l, err = NewSQLiteTransactionLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if seq := l.LastSequence(); seq != 4 {
+		t.Errorf("expected last sequence 4 after reopening, instead got %d", seq)
+	}
+	var read []Event
+	events, errs := l.ReadEvents()
+	for e := range events {
+		read = append(read, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 4 {
+		t.Fatalf("expected 4 events, instead got %d", len(read))
+	}
+	if read[0].Key != "a" || read[0].Value != "1" || !read[0].Timestamp.Equal(modified) {
+		t.Errorf("unexpected first event %+v", read[0])
+	}
+	if read[1].Namespace != "other" || read[1].ValueType != core.TypeList || read[2].EventType != EventDelete {
+		t.Errorf("unexpected events %+v", read[1:])
+	}
+	// The field of hash events should be kept
+	if read[3].EventType != EventHashDelete || read[3].Key != "c" || read[3].Field != "f" {
+		t.Errorf("unexpected hash event %+v", read[3])
+	}
+	// Only events after the sequence should be read
+	read = nil
+	events, errs = l.(*SQLiteTransactionLogger).ReadEventsAfter(3)
+	for e := range events {
+		read = append(read, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 || read[0].Sequence != 4 {
+		t.Errorf("expected only event 4, instead got %+v", read)
+	}
+}
@@ -0,0 +1,293 @@
+package transaction_logs
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchemaVersion is the version of the schema created by this version of
+// vile, which is recorded in the database's user_version
+const sqliteSchemaVersion = 3
+
+// sqliteBatchSize is the maximum number of queued events written in a
+// single transaction, which amortizes the cost of syncing the file
+const sqliteBatchSize = 64
+
+// SQLiteTransactionLogger is a struct that satisfies the TransactionLogger
+// interface, and writes logs to an embedded SQLite database file
+type SQLiteTransactionLogger struct {
+	events       chan<- Event // Write-only channel for sending events
+	errors       <-chan error // Read-only channel for receiving errors
+	lastSequence uint64       // The last recorded event sequence number
+	mu           sync.Mutex   // Guards lastSequence while events are queued
+	db           *sql.DB      // Database access interface
+	path         string       // Location of the database file
+	wg           sync.WaitGroup
+	done         chan struct{} // Closed once Run's goroutine has stopped
+}
+
+// NewSQLiteTransactionLogger is a constructor for the SQLiteTransactionLogger type,
+// it takes the path of the database file, which is created if it doesn't exist,
+// and it returns a TransactionLogger interface or any errors if they occur
+func NewSQLiteTransactionLogger(path string) (TransactionLogger, error) {
+	// WAL mode lets events be read while they are being written
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open sqlite transaction log: %w", err)
+	}
+	l := &SQLiteTransactionLogger{db: db, path: path}
+	if err = l.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot migrate sqlite transaction log: %w", err)
+	}
+	// New events continue from the last sequence in the table
+	err = db.QueryRow("SELECT COALESCE(MAX(sequence), 0) FROM transactions").Scan(&l.lastSequence)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot read last sequence: %w", err)
+	}
+	return l, nil
+}
+
+// migrate creates the transactions table, refusing to open
+// a database created by a newer version of vile
+func (l *SQLiteTransactionLogger) migrate() error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var version int
+	if err = tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > sqliteSchemaVersion {
+		return fmt.Errorf("%w: sqlite schema version %d, latest known version %d",
+			ErrSchemaTooNew, version, sqliteSchemaVersion)
+	}
+	if version == sqliteSchemaVersion {
+		return nil
+	}
+	// Each version's statements upgrade the schema from the previous version
+	versions := [][]string{
+		{`CREATE TABLE IF NOT EXISTS transactions (
+			sequence   INTEGER PRIMARY KEY,
+			event_type INTEGER NOT NULL,
+			namespace  TEXT NOT NULL DEFAULT '',
+			key        TEXT NOT NULL,
+			value      TEXT NOT NULL DEFAULT '',
+			key_id     TEXT NOT NULL DEFAULT '',
+			event_time TIMESTAMP,
+			node_id    TEXT NOT NULL DEFAULT ''
+		)`},
+		{`ALTER TABLE transactions ADD COLUMN value_type TEXT NOT NULL DEFAULT ''`},
+		{`ALTER TABLE transactions ADD COLUMN field TEXT NOT NULL DEFAULT ''`},
+	}
+	var statements []string
+	for _, stmts := range versions[version:] {
+		statements = append(statements, stmts...)
+	}
+	statements = append(statements, fmt.Sprintf("PRAGMA user_version = %d", sqliteSchemaVersion))
+	for _, stmt := range statements {
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Run method initializes channels, listens for channel inputs and logs events accordingly
+func (l *SQLiteTransactionLogger) Run() {
+	// Initialize the events channel
+	events := make(chan Event, 16)
+	l.events = events
+	// Initialize the errors channel
+	errs := make(chan error, 1)
+	l.errors = errs
+	done := make(chan struct{})
+	l.done = done
+	// Run a goroutine to constantly handle new events coming over channels
+	go func() {
+		defer close(done)
+		for e := range events {
+			// Write any other queued events in the same transaction
+			batch := []Event{e}
+			for len(batch) < sqliteBatchSize && len(events) > 0 {
+				batch = append(batch, <-events)
+			}
+			err := l.write(batch)
+			if err != nil {
+				writeErrors.Add(float64(len(batch)))
+				for _, e := range batch {
+					select {
+					case errs <- newEventError(e, err):
+					default:
+					}
+				}
+			}
+			for range batch {
+				l.wg.Done()
+			}
+		}
+	}()
+}
+
+// write method encrypts the events' values and writes them in a single transaction
+func (l *SQLiteTransactionLogger) write(batch []Event) (err error) {
+	spans := make([]trace.Span, len(batch))
+	for i, e := range batch {
+		spans[i] = e.startSpan("transaction_log.write")
+	}
+	defer func() {
+		for _, span := range spans {
+			endSpan(span, err)
+		}
+	}()
+	start := time.Now()
+	defer func() { writeDuration.Observe(time.Since(start).Seconds()) }()
+	tx, err := l.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO transactions
+		(sequence, event_type, namespace, key, field, value, value_type, key_id, event_time, node_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("cannot prepare insert: %w", err)
+	}
+	defer stmt.Close()
+	for _, e := range batch {
+		if e, err = e.encrypt(); err != nil {
+			return err
+		}
+		_, err = stmt.Exec(e.Sequence, e.EventType, e.Namespace, e.Key, e.Field, e.Value, e.ValueType, e.KeyID, e.Timestamp, e.NodeID)
+		if err != nil {
+			return fmt.Errorf("cannot insert event: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit events: %w", err)
+	}
+	return nil
+}
+
+// ReadEvents method reads every event in the database
+func (l *SQLiteTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	return l.ReadEventsAfter(0)
+}
+
+// ReadEventsAfter method reads the events with a sequence greater than the
+// provided sequence, it can be used while the logger is running
+func (l *SQLiteTransactionLogger) ReadEventsAfter(sequence uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)    // Unbuffered event channel to stream concurrent events
+	outError := make(chan error, 1) // Buffered error channel to stream concurrent errors
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+		rows, err := l.db.Query(`SELECT sequence, event_type, namespace, key, field, value, value_type, key_id, event_time, node_id
+			FROM transactions WHERE sequence > ? ORDER BY sequence`, sequence)
+		if err != nil {
+			outError <- fmt.Errorf("cannot read sqlite transaction log: %w", err)
+			return
+		}
+		defer rows.Close()
+		restored := 0
+		for rows.Next() {
+			var e Event
+			var timestamp sql.NullTime
+			err = rows.Scan(&e.Sequence, &e.EventType, &e.Namespace, &e.Key, &e.Field, &e.Value, &e.ValueType, &e.KeyID, &timestamp, &e.NodeID)
+			if err != nil {
+				outError <- fmt.Errorf("cannot read event: %w", err)
+				return
+			}
+			e.Timestamp = timestamp.Time
+			if e, err = e.decrypt(); err != nil {
+				outError <- err
+				return
+			}
+			restored++
+			outEvent <- e
+		}
+		if err = rows.Err(); err != nil {
+			outError <- fmt.Errorf("cannot read sqlite transaction log: %w", err)
+			return
+		}
+		if sequence == 0 {
+			slog.Info("Read sqlite transaction log", "path", l.path, "events", restored)
+		}
+	}()
+	return outEvent, outError
+}
+
+// WritePut method logs PUT events for the provided key:value pair
+func (l *SQLiteTransactionLogger) WritePut(key, value string) {
+	l.WriteEvent(Event{EventType: EventPut, Key: key, Value: value})
+}
+
+// WriteDelete method logs DELETE events for the provided key
+func (l *SQLiteTransactionLogger) WriteDelete(key string) {
+	l.WriteEvent(Event{EventType: EventDelete, Key: key})
+}
+
+// WriteEvent method logs the provided event, returning the sequence number assigned to the event
+func (l *SQLiteTransactionLogger) WriteEvent(e Event) uint64 {
+	// Trace the time spent waiting for space in the events channel
+	span := e.startSpan("transaction_log.enqueue")
+	defer span.End()
+	l.wg.Add(1)
+	// Sequences are assigned while queueing so events are written in order
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastSequence++
+	e.Sequence = l.lastSequence
+	l.events <- e.stamp()
+	return e.Sequence
+}
+
+// Err method returns any errors that have been read from the logger's error channel
+func (l *SQLiteTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// Wait method blocks until every queued event has been written
+func (l *SQLiteTransactionLogger) Wait() {
+	l.wg.Wait()
+}
+
+// Close method writes any queued events and closes the database
+func (l *SQLiteTransactionLogger) Close() error {
+	if l.events != nil {
+		close(l.events)
+		<-l.done
+	}
+	return l.db.Close()
+}
+
+// LastSequence method returns the sequence assigned to the most recent event
+func (l *SQLiteTransactionLogger) LastSequence() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSequence
+}
+
+// QueueDepth method returns the number of events waiting to be written
+func (l *SQLiteTransactionLogger) QueueDepth() int {
+	return len(l.events)
+}
+
+// Ping method checks that the database is readable
+func (l *SQLiteTransactionLogger) Ping() error {
+	var n int
+	if err := l.db.QueryRow("SELECT 1").Scan(&n); err != nil {
+		return fmt.Errorf("sqlite transaction log is unreadable: %w", err)
+	}
+	return nil
+}